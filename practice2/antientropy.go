@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// merkleDepth is the depth of the Merkle tree: features are hashed into
+// 1<<merkleDepth buckets by id.
+const merkleDepth = 8
+
+var repairClient = &http.Client{Timeout: 10 * time.Second}
+
+// merkleTree holds the hashes of a binary Merkle tree by level, the root
+// first and the buckets last.
+type merkleTree [][]string
+
+// repairStats counts what a repair did.
+type repairStats struct {
+	Peers   int `json:"peers"`
+	Buckets int `json:"buckets"`
+	Checked int `json:"checked"`
+	Fixed   int `json:"fixed"`
+}
+
+func (s *repairStats) add(o repairStats) {
+	s.Peers += o.Peers
+	s.Buckets += o.Buckets
+	s.Checked += o.Checked
+	s.Fixed += o.Fixed
+}
+
+// WithAntiEntropy makes the Storage repair itself from its replicas every
+// interval, see repair.
+func WithAntiEntropy(interval time.Duration) StorageOption {
+	return func(s *Storage) {
+		s.repairInterval = interval
+	}
+}
+
+// bucket returns the Merkle tree bucket of a feature id.
+func bucket(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % (1 << merkleDepth))
+}
+
+// entries returns the state of the features in a bucket as checkpoint
+// records, ordered by id, see records. The caller holds e.mu.
+func (e *Engine) entries(b int) []*Transaction {
+	var txns []*Transaction
+	for _, txn := range e.records() {
+		if bucket(txn.Feature.ID.(string)) == b {
+			txns = append(txns, txn)
+		}
+	}
+	slices.SortStableFunc(txns, func(a, b *Transaction) int {
+		return strings.Compare(a.Feature.ID.(string), b.Feature.ID.(string))
+	})
+	return txns
+}
+
+// contentHash hashes the geometry and properties of a feature. The keys of
+// the properties are sorted, so replicas with the same content hash it
+// alike.
+func contentHash(feature *geojson.Feature) [sha256.Size]byte {
+	geometry, _ := geojson.NewGeometry(feature.Geometry).MarshalJSON()
+	properties, _ := json.Marshal(feature.Properties)
+	return sha256.Sum256(append(append(geometry, 0), properties...))
+}
+
+// digest hashes the id, version, state and content of a feature.
+func digest(txn *Transaction) []byte {
+	return fmt.Appendf(nil, "%s\x00%d\x00%s\x00%x\n", txn.Feature.ID, txn.Version, txn.Action, contentHash(txn.Feature))
+}
+
+// merkle builds the Merkle tree of the features, live and deleted.
+func (e *Engine) merkle() merkleTree {
+	e.mu.Lock()
+	leaves := make([]*bytes.Buffer, 1<<merkleDepth)
+	for i := range leaves {
+		leaves[i] = &bytes.Buffer{}
+	}
+	txns := e.records()
+	e.mu.Unlock()
+
+	slices.SortStableFunc(txns, func(a, b *Transaction) int {
+		return strings.Compare(a.Feature.ID.(string), b.Feature.ID.(string))
+	})
+	for _, txn := range txns {
+		leaves[bucket(txn.Feature.ID.(string))].Write(digest(txn))
+	}
+
+	level := make([]string, len(leaves))
+	for i, leaf := range leaves {
+		sum := sha256.Sum256(leaf.Bytes())
+		level[i] = hex.EncodeToString(sum[:])
+	}
+	tree := merkleTree{level}
+	for len(level) > 1 {
+		up := make([]string, len(level)/2)
+		for i := range up {
+			sum := sha256.Sum256([]byte(level[2*i] + level[2*i+1]))
+			up[i] = hex.EncodeToString(sum[:])
+		}
+		tree = append(merkleTree{up}, tree...)
+		level = up
+	}
+	return tree
+}
+
+// diff descends both trees from the root into the subtrees that differ and
+// returns the buckets with different hashes.
+func (t merkleTree) diff(o merkleTree) []int {
+	if len(t) != len(o) {
+		return nil
+	}
+	nodes := []int{0}
+	for depth := range t {
+		var next []int
+		for _, i := range nodes {
+			if t[depth][i] == o[depth][i] {
+				continue
+			}
+			if depth == len(t)-1 {
+				next = append(next, i)
+			} else {
+				next = append(next, 2*i, 2*i+1)
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+// wins reports whether the state of a feature at a replica, given as the
+// last record for the id, is newer than the local one. States no clock
+// orders that differ anyway are tied, see beats.
+func (e *Engine) wins(id string, theirs *Transaction) bool {
+	ours, deleted := e.current(id)
+	if ours == nil {
+		return true
+	}
+	if ours.clock != nil && theirs.Clock != nil {
+		switch compare(theirs.Clock, ours.merged()) {
+		case after:
+			return true
+		case before:
+			return false
+		case equal:
+			return beats(theirs, ours, deleted)
+		}
+		return newer(&sibling{Name: theirs.Name, HLC: theirs.HLC}, ours.sibling())
+	}
+	if theirs.Version != ours.version {
+		return theirs.Version > ours.version
+	}
+	return beats(theirs, ours, deleted)
+}
+
+// beats breaks the tie between two states of a feature at the same version:
+// a delete wins over a live feature, else the greater content hash wins, so
+// that both replicas keep the same one.
+func beats(theirs *Transaction, ours *record, deleted bool) bool {
+	if (theirs.Action == "delete") != deleted {
+		return !deleted
+	}
+	a, b := contentHash(theirs.Feature), contentHash(ours.feature)
+	return bytes.Compare(a[:], b[:]) > 0
+}
+
+// fix takes the features of a bucket a replica has newer than the local
+// ones. Their records are logged as repairs before they are applied.
+func (e *Engine) fix(theirs []*Transaction) (checked, fixed int, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// a deleted feature comes as an insert followed by a delete
+	last := make(map[string]*Transaction)
+	var ids []string
+	for _, txn := range theirs {
+		id := txn.Feature.ID.(string)
+		if _, ok := last[id]; !ok {
+			ids = append(ids, id)
+		}
+		last[id] = txn
+	}
+	for _, id := range ids {
+		checked++
+		if !e.wins(id, last[id]) {
+			continue
+		}
+		for _, txn := range theirs {
+			if txn.Feature.ID.(string) != id || (txn.Action != "insert" && txn.Action != "delete") {
+				continue
+			}
+			txn.Repair = true
+			txn.LSN = 0
+			if txn.Time == 0 {
+				// deletes keep their time for the trash
+				txn.Time = time.Now().UnixNano()
+			}
+			e.seq++
+			txn.Seq = e.seq
+			data, err := json.Marshal(txn)
+			if err != nil {
+				return checked, fixed, err
+			}
+			txn.size = int64(len(data))
+			if _, err := e.logFile.Write(append(data, '\n')); err != nil {
+				return checked, fixed, err
+			}
+			e.history = append(e.history, txn)
+			e.applyRepair(txn)
+		}
+		fixed++
+	}
+	return checked, fixed, nil
+}
+
+// applyRepair applies a repair record: an insert forgets the local state of
+// the feature first, the replica's replaces it whatever the versions.
+func (e *Engine) applyRepair(txn *Transaction) {
+	if txn.Action == "insert" {
+		e.forget(txn.Feature.ID.(string))
+	}
+	e.applyTransaction(txn)
+}
+
+// forget drops a feature from the indexes. The caller holds e.mu.
+func (e *Engine) forget(id string) {
+	if rec, exists := e.primary[id]; exists {
+		min, max := bound(rec.feature)
+		e.spatial.Delete(min, max, id)
+		e.count(rec, -1)
+		delete(e.primary, id)
+	}
+	delete(e.trash, id)
+}
+
+func getJSON(url string, v any) error {
+	resp, err := repairClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(url + ": " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// repairFrom compares the Merkle trees with a replica and takes the
+// features it has newer from the buckets that differ.
+func (e *Engine) repairFrom(addr string) (repairStats, error) {
+	stats := repairStats{Peers: 1}
+	addr = strings.TrimSuffix(addr, "/")
+	var theirs merkleTree
+	if err := getJSON(addr+"/merkle", &theirs); err != nil {
+		return stats, err
+	}
+	buckets := e.merkle().diff(theirs)
+	stats.Buckets = len(buckets)
+	for _, b := range buckets {
+		var txns []*Transaction
+		if err := getJSON(addr+"/merkle/"+strconv.Itoa(b), &txns); err != nil {
+			return stats, err
+		}
+		checked, fixed, err := e.fix(txns)
+		stats.Checked += checked
+		stats.Fixed += fixed
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// repair runs anti-entropy with every replica: differences the log
+// shipping can't heal, such as lost logs, are found by comparing Merkle
+// trees of the features and fixed by taking the newer state. Replicas
+// repair themselves from this Storage the same way.
+func (s *Storage) repair() (repairStats, error) {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		stats repairStats
+		errs  []error
+	)
+	for _, addr := range s.eng.replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run, err := s.eng.repairFrom(addr)
+			mu.Lock()
+			defer mu.Unlock()
+			stats.add(run)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.repairMu.Lock()
+	s.repaired.add(stats)
+	s.repairRuns++
+	s.repairMu.Unlock()
+	if stats.Fixed > 0 {
+		slog.Info("anti-entropy repaired features", slog.String("storage", s.name), slog.Int("fixed", stats.Fixed))
+	}
+	return stats, errors.Join(errs...)
+}
+
+// antiEntropy repairs every interval until the Storage is stopped.
+func (s *Storage) antiEntropy() {
+	ticker := time.NewTicker(s.repairInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.repair(); err != nil {
+				slog.Error("anti-entropy", slog.String("storage", s.name), slog.String("error", err.Error()))
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Storage) merkleHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.eng.merkle())
+}
+
+// bucketHandler returns the features of a Merkle tree bucket as checkpoint
+// records.
+func (s *Storage) bucketHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := strconv.Atoi(r.PathValue("bucket"))
+	if err != nil || b < 0 || b >= 1<<merkleDepth {
+		http.Error(w, "invalid bucket", http.StatusBadRequest)
+		return
+	}
+	s.eng.mu.Lock()
+	txns := s.eng.entries(b)
+	s.eng.mu.Unlock()
+	if txns == nil {
+		txns = []*Transaction{}
+	}
+	writeJSON(w, txns)
+}
+
+// repairHandler runs anti-entropy right away. It answers with what this run
+// did and the totals since the Storage started.
+func (s *Storage) repairHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("repair method")
+	stats, err := s.repair()
+	if err != nil {
+		slog.Error("repair", slog.String("storage", s.name), slog.String("error", err.Error()))
+	}
+	s.repairMu.Lock()
+	total, runs := s.repaired, s.repairRuns
+	s.repairMu.Unlock()
+	body := map[string]any{"run": stats, "total": total, "runs": runs}
+	if err != nil {
+		body["error"] = err.Error()
+	}
+	writeJSON(w, body)
+}
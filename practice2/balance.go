@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxHops is how many times a read may be redirected between replicas.
+	maxHops = 3
+	// statusInterval is how often the status of the replicas is polled.
+	statusInterval = time.Second
+)
+
+var statusClient = &http.Client{Timeout: time.Second}
+
+// replicaStatus is what a Storage knows of a replica from its /status.
+type replicaStatus struct {
+	addr     string
+	name     string
+	vclock   map[string]uint64
+	inflight int64
+}
+
+// balancer keeps the status of the replicas reads may be redirected to.
+type balancer struct {
+	mu       sync.Mutex
+	replicas map[string]*replicaStatus
+}
+
+// WithReadThreshold makes the Storage redirect /select requests to the
+// least loaded replica with 307 while more than n of them are in flight.
+// Zero, the default, serves every read locally.
+func WithReadThreshold(n int64) StorageOption {
+	return func(s *Storage) {
+		s.readThreshold = n
+	}
+}
+
+// lag returns how many transactions applied here the vector clock misses.
+func lag(local, replica map[string]uint64) uint64 {
+	var n uint64
+	for name, lsn := range local {
+		if lsn > replica[name] {
+			n += lsn - replica[name]
+		}
+	}
+	return n
+}
+
+// poll refreshes the status of the replicas until the Storage is stopped.
+func (s *Storage) poll() {
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	for {
+		s.refresh()
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh fetches the status of every replica. Replicas that don't answer
+// are forgotten until they do.
+func (s *Storage) refresh() {
+	var wg sync.WaitGroup
+	for _, addr := range s.eng.replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, err := fetchStatus(addr)
+			s.balancer.mu.Lock()
+			defer s.balancer.mu.Unlock()
+			if err != nil {
+				delete(s.balancer.replicas, addr)
+				return
+			}
+			s.balancer.replicas[addr] = status
+		}()
+	}
+	wg.Wait()
+}
+
+func fetchStatus(addr string) (*replicaStatus, error) {
+	resp, err := statusClient.Get(strings.TrimSuffix(addr, "/") + "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Name     string            `json:"name"`
+		VClock   map[string]uint64 `json:"vclock"`
+		InFlight int64             `json:"inflight"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return &replicaStatus{addr: addr, name: body.Name, vclock: body.VClock, inflight: body.InFlight}, nil
+}
+
+// pick chooses the replica to redirect a read to: the least loaded one, then
+// the least behind, among those not visited yet, with the write of the
+// token, at most maxStaleness transactions behind if bounded, and below
+// the threshold if loaded.
+func (s *Storage) pick(visited []string, token *consistencyToken, maxStaleness uint64, bounded, loaded bool) *replicaStatus {
+	local := s.eng.clock()
+	s.balancer.mu.Lock()
+	defer s.balancer.mu.Unlock()
+	var best *replicaStatus
+	var bestLag uint64
+	for _, status := range s.balancer.replicas {
+		behind := lag(local, status.vclock)
+		switch {
+		case slices.Contains(visited, status.name), !token.covered(status.vclock):
+			continue
+		case loaded && status.inflight >= s.readThreshold:
+			continue
+		case bounded && behind > maxStaleness:
+			continue
+		}
+		if best == nil || status.inflight < best.inflight ||
+			(status.inflight == best.inflight && behind < bestLag) ||
+			(status.inflight == best.inflight && behind == bestLag && status.addr < best.addr) {
+			best, bestLag = status, behind
+		}
+	}
+	return best
+}
+
+// balance wraps the select handler. It counts the reads in flight and, over
+// the threshold, redirects to a replica. The hops and visited query
+// parameters keep the redirects from going round in circles, maxStaleness
+// refuses replicas that many transactions behind.
+func (s *Storage) balance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inflight := s.inflight.Add(1)
+		defer s.inflight.Add(-1)
+		if s.readThreshold <= 0 || inflight <= s.readThreshold {
+			next(w, r)
+			return
+		}
+
+		query := r.URL.Query()
+		hops, _ := strconv.Atoi(query.Get("hops"))
+		var visited []string
+		if v := query.Get("visited"); v != "" {
+			visited = strings.Split(v, ",")
+		}
+		visited = append(visited, s.name)
+		maxStaleness, err := strconv.ParseUint(query.Get("maxStaleness"), 10, 64)
+		bounded := err == nil
+		if query.Has("maxStaleness") && !bounded {
+			http.Error(w, "invalid maxStaleness", http.StatusBadRequest)
+			return
+		}
+		token, err := readToken(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var target *replicaStatus
+		if hops < maxHops {
+			target = s.pick(visited, token, maxStaleness, bounded, true)
+		}
+		if target == nil {
+			next(w, r)
+			return
+		}
+		query.Set("hops", strconv.Itoa(hops+1))
+		query.Set("visited", strings.Join(visited, ","))
+		if token != nil {
+			query.Set("token", token.String())
+		}
+		u := strings.TrimSuffix(target.addr, "/") + "/select?" + query.Encode()
+		slog.Info("redirecting read", slog.String("storage", s.name), slog.String("replica", target.name), slog.Int64("inflight", inflight))
+		http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+	}
+}
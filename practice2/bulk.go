@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	// importWindow is how many features of an import stream are read before
+	// they are sent to the shards. The stream isn't read further until they
+	// are stored, which holds back a client faster than the shards.
+	importWindow = 1000
+	// maxBatch is how many features go to a shard in one request.
+	maxBatch = 500
+	// maxImportErrors is how many error messages an import summary keeps.
+	maxImportErrors = 20
+)
+
+var (
+	errInvalidFeature = errors.New("invalid feature")
+	errImporting      = errors.New("the import is running")
+)
+
+// batchFailure is a feature a batch couldn't insert.
+type batchFailure struct {
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// batchResult counts what a batch insert did with its features.
+type batchResult struct {
+	Inserted   int            `json:"inserted"`
+	Duplicates int            `json:"duplicates"`
+	Failed     []batchFailure `json:"failed"`
+}
+
+// batchHandler inserts a feature collection, feature by feature: features
+// whose id exists are duplicates, others that can't be inserted failures,
+// neither stops the batch. The write concern is awaited once for all of
+// them. A batch routed with a stale routing table is refused as a whole.
+func (s *Storage) batchHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("batch method")
+	concern, timeout, err := s.writeConcern(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	col, err := geojson.UnmarshalFeatureCollection(data)
+	if err != nil {
+		http.Error(w, "invalid geojson", http.StatusBadRequest)
+		return
+	}
+	for _, feature := range col.Features {
+		if id, err := parseID(feature.ID); err == nil && feature.Geometry != nil {
+			if version := s.misrouted(r, id, feature); version > 0 {
+				refuseMisrouted(w, version)
+				return
+			}
+		}
+	}
+
+	result := batchResult{Failed: []batchFailure{}}
+	var last *Transaction
+	for _, feature := range col.Features {
+		if feature.Geometry == nil {
+			result.Failed = append(result.Failed, batchFailure{Error: "invalid geojson"})
+			continue
+		}
+		id, err := s.assignID(feature)
+		if err != nil {
+			result.Failed = append(result.Failed, batchFailure{Error: err.Error()})
+			continue
+		}
+		txn := &Transaction{Action: "insert", Name: s.name, LSN: s.eng.lsn.Load(), Feature: feature}
+		res := s.exec(txn)
+		switch {
+		case errors.Is(res.err, errExists):
+			result.Duplicates++
+		case res.err != nil:
+			result.Failed = append(result.Failed, batchFailure{ID: id, Error: res.err.Error()})
+		default:
+			result.Inserted++
+			last = txn
+			s.recordFeature(loadWrite, feature, int(txn.size))
+		}
+	}
+	if last != nil {
+		w.Header().Set(tokenHeader, consistencyToken{name: last.Name, lsn: last.LSN}.String())
+		if n := s.eng.required(concern); n > 0 {
+			if acks, ok := s.eng.await(last.LSN, n, timeout); !ok {
+				writeError(w, &ackError{concern: concern, acks: acks, required: n})
+				return
+			}
+		}
+	}
+	writeJSON(w, result)
+}
+
+// shardImport counts what the features of an import sent to a shard became.
+type shardImport struct {
+	Inserted   int `json:"inserted"`
+	Duplicates int `json:"duplicates"`
+	Failed     int `json:"failed"`
+}
+
+// importState is the progress of an import. Read features of the stream
+// are stored or counted as failed, and so are the Acked ones past them,
+// whose shards took them in a window that failed on other shards; an
+// import resumed with the same id skips both. Rejected features are those
+// no shard was asked for, such as invalid or outside the map.
+type importState struct {
+	ID       string                  `json:"id"`
+	Started  time.Time               `json:"started"`
+	Read     int                     `json:"read"`
+	Acked    []int                   `json:"acked,omitempty"`
+	Rejected int                     `json:"rejected"`
+	Done     bool                    `json:"done"`
+	Shards   map[string]*shardImport `json:"shards"`
+	Errors   []string                `json:"errors"`
+
+	running bool
+}
+
+func (r *Router) importsPath() string {
+	return r.tablePath + ".imports"
+}
+
+// loadImports reads the imports saved by a Router that was stopped.
+func (r *Router) loadImports() {
+	if r.tablePath == "" {
+		return
+	}
+	data, err := os.ReadFile(r.importsPath())
+	if err != nil {
+		return
+	}
+	r.importMu.Lock()
+	defer r.importMu.Unlock()
+	if err := json.Unmarshal(data, &r.imports); err != nil {
+		slog.Error("imports", slog.String("error", err.Error()))
+	}
+}
+
+// saveImports writes the progress of the imports next to the routing
+// table. The caller holds importMu.
+func (r *Router) saveImports() error {
+	if r.tablePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(r.imports)
+	if err != nil {
+		return err
+	}
+	tmp := r.importsPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.importsPath())
+}
+
+// fail notes an error in the summary, the first ones only. The
+// caller holds importMu.
+func (state *importState) fail(msg string) {
+	if len(state.Errors) < maxImportErrors {
+		state.Errors = append(state.Errors, msg)
+	}
+}
+
+func (state *importState) shard(addr string) *shardImport {
+	s, ok := state.Shards[addr]
+	if !ok {
+		s = &shardImport{}
+		state.Shards[addr] = s
+	}
+	return s
+}
+
+// featureStream returns the features of an import body one at a time:
+// NDJSON or GeoJSON text sequences with a feature per line when the
+// Content-Type says so, else a GeoJSON feature collection, read as it
+// comes. A feature that can't be decoded is errInvalidFeature, the stream
+// goes on after it; other errors end it, io.EOF when it is read through.
+func featureStream(req *http.Request) func() (*geojson.Feature, error) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "application/x-ndjson" || mediaType == "application/geo+json-seq" {
+		lines := bufio.NewReader(req.Body)
+		return func() (*geojson.Feature, error) {
+			for {
+				line, err := lines.ReadBytes('\n')
+				line = bytes.TrimSpace(bytes.TrimPrefix(line, []byte{0x1e}))
+				if len(line) == 0 {
+					if err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if err != nil && err != io.EOF {
+					return nil, err
+				}
+				feature, ferr := geojson.UnmarshalFeature(line)
+				if ferr != nil {
+					return nil, errInvalidFeature
+				}
+				return feature, nil
+			}
+		}
+	}
+
+	dec := json.NewDecoder(req.Body)
+	inFeatures := false
+	return func() (*geojson.Feature, error) {
+		for !inFeatures {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch tok {
+			case json.Delim('{'), json.Delim('}'):
+				continue
+			case "features":
+				if tok, err = dec.Token(); err != nil {
+					return nil, err
+				}
+				if tok != json.Delim('[') {
+					return nil, errors.New("features is not an array")
+				}
+				inFeatures = true
+			default:
+				// the value of any other member is skipped
+				var skip json.RawMessage
+				if err := dec.Decode(&skip); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !dec.More() {
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			inFeatures = false
+			return nil, io.EOF
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		feature, err := geojson.UnmarshalFeature(raw)
+		if err != nil {
+			return nil, errInvalidFeature
+		}
+		return feature, nil
+	}
+}
+
+// sendBatch inserts features on the leader of a shard.
+func (r *Router) sendBatch(ctx context.Context, shard *Shard, features []*geojson.Feature) (*batchResult, error) {
+	col := geojson.NewFeatureCollection()
+	col.Features = features
+	body, err := col.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.fetch(ctx, "POST", shard.LeaderAddr+"/batch", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusMisdirectedRequest {
+		return nil, errStaleRouting
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{code: resp.StatusCode, body: string(bytes.TrimSpace(data))}
+	}
+	var result batchResult
+	return &result, json.Unmarshal(data, &result)
+}
+
+// window is a part of an import stream: the features to send with their
+// offsets in the stream, and the errors of those that couldn't be decoded.
+type window struct {
+	features []*geojson.Feature
+	offsets  []int
+	read     int
+	rejected []string
+}
+
+// flush sends a window of features to their shards, in batches sent in
+// parallel to the shards and one after the other to each. A shard that
+// says the routing table is stale gets its features routed again with the
+// refreshed one. The batches the shards take are acked as they come, the
+// window is read once every shard took its features.
+func (r *Router) flush(ctx context.Context, state *importState, win *window) error {
+	r.fence.RLock()
+	defer r.fence.RUnlock()
+	pending := make([]int, len(win.features))
+	for i := range pending {
+		pending[i] = i
+	}
+	rejected := win.rejected
+	var failed error
+	for attempt := 0; attempt < 2 && len(pending) > 0 && failed == nil; attempt++ {
+		table := r.routes()
+		batches := map[*Shard][]int{}
+		var shards []*Shard
+		for _, i := range pending {
+			feature := win.features[i]
+			id, err := parseID(feature.ID)
+			if err != nil {
+				rejected = append(rejected, err.Error())
+				continue
+			}
+			shard, err := table.Locate(id, feature.Geometry.Bound())
+			if err != nil {
+				rejected = append(rejected, fmt.Sprintf("feature %s: %s", id, err))
+				continue
+			}
+			if _, ok := batches[shard]; !ok {
+				shards = append(shards, shard)
+			}
+			batches[shard] = append(batches[shard], i)
+		}
+
+		pending = nil
+		var wg sync.WaitGroup
+		for _, shard := range shards {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				indexes := batches[shard]
+				for start := 0; start < len(indexes); start += maxBatch {
+					var batch []*geojson.Feature
+					for _, i := range indexes[start:min(start+maxBatch, len(indexes))] {
+						batch = append(batch, win.features[i])
+					}
+					result, err := r.sendBatch(ctx, shard, batch)
+					r.importMu.Lock()
+					counts := state.shard(shard.LeaderAddr)
+					switch {
+					case errors.Is(err, errStaleRouting):
+						pending = append(pending, indexes[start:]...)
+					case err != nil:
+						counts.Failed += len(indexes) - start
+						state.fail(fmt.Sprintf("shard %s: %s", shard.LeaderAddr, err))
+						failed = err
+					default:
+						counts.Inserted += result.Inserted
+						counts.Duplicates += result.Duplicates
+						counts.Failed += len(result.Failed)
+						for _, f := range result.Failed {
+							state.fail(fmt.Sprintf("feature %s: %s", f.ID, f.Error))
+						}
+						for _, i := range indexes[start:min(start+maxBatch, len(indexes))] {
+							state.Acked = append(state.Acked, win.offsets[i])
+						}
+					}
+					r.importMu.Unlock()
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	if failed == nil && len(pending) > 0 {
+		failed = errStaleRouting
+	}
+
+	r.importMu.Lock()
+	defer r.importMu.Unlock()
+	if failed == nil {
+		state.Read += win.read
+		state.Acked = nil
+		state.Rejected += len(rejected)
+		for _, msg := range rejected {
+			state.fail(msg)
+		}
+	}
+	if err := r.saveImports(); err != nil && failed == nil {
+		failed = err
+	}
+	return failed
+}
+
+// writeSummary answers with the summary of an import.
+func (r *Router) writeSummary(w http.ResponseWriter, code int, state *importState) {
+	r.importMu.Lock()
+	data, err := json.Marshal(state)
+	r.importMu.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// routeImport loads a stream of features into the shards, see
+// featureStream, and answers with what every shard did with them. The id
+// parameter names the import, a new one is made without it: sending the
+// same stream again with the id resumes an import that failed where it
+// stopped: features a shard already took aren't sent again. Features
+// without an id are given the one of their place in the stream, see
+// sequenceID, so those of a batch that failed after being stored are found
+// as duplicates when sent again rather than stored twice.
+func (r *Router) routeImport(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		id = newID()
+	}
+	r.importMu.Lock()
+	state, ok := r.imports[id]
+	if !ok {
+		state = &importState{ID: id, Started: time.Now(), Shards: map[string]*shardImport{}, Errors: []string{}}
+		r.imports[id] = state
+	}
+	if state.running {
+		r.importMu.Unlock()
+		http.Error(w, errImporting.Error(), http.StatusConflict)
+		return
+	}
+	state.running = true
+	skip, done, started := state.Read, state.Done, state.Started
+	acked := map[int]bool{}
+	for _, n := range state.Acked {
+		acked[n] = true
+	}
+	r.importMu.Unlock()
+	defer func() {
+		r.importMu.Lock()
+		state.running = false
+		r.importMu.Unlock()
+	}()
+	if done {
+		r.writeSummary(w, http.StatusOK, state)
+		return
+	}
+	if skip > 0 {
+		slog.Info("resuming import", slog.String("id", id), slog.Int("read", skip))
+	}
+
+	ctx := context.WithoutCancel(req.Context())
+	next := featureStream(req)
+	win := &window{}
+	for n := 0; ; n++ {
+		feature, err := next()
+		if err == io.EOF {
+			break
+		}
+		if n < skip {
+			continue
+		}
+		switch {
+		case errors.Is(err, errInvalidFeature) || (err == nil && feature.Geometry == nil):
+			win.rejected = append(win.rejected, fmt.Sprintf("feature %d: %s", n, errInvalidFeature))
+		case err != nil:
+			http.Error(w, "invalid import stream: "+err.Error(), http.StatusBadRequest)
+			return
+		case acked[n]:
+			// stored before the import stopped
+		default:
+			if feature.ID == nil {
+				feature.ID = sequenceID(id, started, n)
+			}
+			win.features = append(win.features, feature)
+			win.offsets = append(win.offsets, n)
+		}
+		if win.read++; win.read == importWindow {
+			if err := r.flush(ctx, state, win); err != nil {
+				r.writeSummary(w, http.StatusBadGateway, state)
+				return
+			}
+			win = &window{}
+		}
+	}
+	if err := r.flush(ctx, state, win); err != nil {
+		r.writeSummary(w, http.StatusBadGateway, state)
+		return
+	}
+	r.importMu.Lock()
+	state.Done = true
+	err := r.saveImports()
+	r.importMu.Unlock()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	slog.Info("import done", slog.String("id", id), slog.Int("read", state.Read))
+	r.writeSummary(w, http.StatusOK, state)
+}
+
+// importStatus answers with the summary of an import.
+func (r *Router) importStatus(w http.ResponseWriter, req *http.Request) {
+	r.importMu.Lock()
+	state, ok := r.imports[req.PathValue("id")]
+	r.importMu.Unlock()
+	if !ok {
+		writeError(w, errNotFound)
+		return
+	}
+	r.writeSummary(w, http.StatusOK, state)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/tidwall/rtree"
+)
+
+// checkpointSnapshot is the full state of a Storage, shipped to a replica
+// that is too far behind to catch up from the log.
+type checkpointSnapshot struct {
+	Action   string            `json:"action"`
+	Name     string            `json:"name"`
+	LastTerm uint64            `json:"lastTerm,omitempty"`
+	VClock   map[string]uint64 `json:"vclock"`
+	Records  []*Transaction    `json:"records"`
+}
+
+// backlog returns the local transactions made after lsn, if the retained
+// log still has every one of them.
+func (e *Engine) backlog(lsn uint64) ([]*Transaction, bool) {
+	var txns []*Transaction
+	next := lsn + 1
+	for _, txn := range e.history {
+		if txn.Name != e.name || txn.LSN <= lsn {
+			continue
+		}
+		if txn.LSN != next {
+			return nil, false
+		}
+		txns = append(txns, txn)
+		next++
+	}
+	return txns, next == e.lsn.Load()+1
+}
+
+// attach registers a replica that has applied the transactions in vclock.
+// It is first sent the local transactions it missed, or a snapshot when
+// the log doesn't have all of them anymore. Both are taken under the same
+// lock as the broadcasts, so nothing is lost or sent twice in between.
+//
+// With elections, an elected leader also ships a snapshot to replicas that
+// hold transactions it doesn't have: those were fenced off. Followers never
+// ship snapshots, their state may be stale.
+func (e *Engine) attach(p *peer, vclock map[string]uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	backlog, ok := e.backlog(vclock[e.name])
+	elected := e.addr != ""
+	if elected && e.leader && !covers(e.vclock, vclock, "") {
+		ok = false
+	}
+	if ok || (elected && !e.leader) {
+		p.backlog = backlog
+	} else {
+		slog.Info("replica is behind the log, shipping snapshot", slog.String("peer", p.name))
+		snap := &checkpointSnapshot{
+			Action:   "snapshot",
+			Name:     e.name,
+			LastTerm: e.lastTerm,
+			VClock:   make(map[string]uint64, len(e.vclock)),
+			Records:  e.records(),
+		}
+		for name, lsn := range e.vclock {
+			snap.VClock[name] = lsn
+		}
+		p.snapshot = snap
+	}
+	e.register(p)
+}
+
+// install replaces the state with a snapshot shipped by a replica. Logged
+// transactions the snapshot doesn't have yet are applied again on top of
+// it, unless they are fenced, and the result is checkpointed. History
+// before the snapshot is lost.
+func (e *Engine) install(snap *checkpointSnapshot) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var newer []*Transaction
+	for _, txn := range e.history {
+		if txn.LSN > snap.VClock[txn.Name] && !e.fenced(txn) {
+			newer = append(newer, txn)
+		}
+	}
+
+	e.primary = make(map[string]*record, len(snap.Records))
+	e.trash = make(map[string]*tombstone)
+	e.spatial = &rtree.RTree{}
+	e.cells = make(map[[4]float64]*cellSize)
+	for _, txn := range snap.Records {
+		e.applyTransaction(txn)
+	}
+	e.lastTerm = snap.LastTerm
+	e.vclock = make(map[string]uint64, len(snap.VClock))
+	for name, lsn := range snap.VClock {
+		e.vclock[name] = lsn
+	}
+	close(e.progress)
+	e.progress = make(chan struct{})
+	for _, txn := range newer {
+		e.applyTransaction(txn)
+		e.tick(txn)
+	}
+	if e.lsn.Load() < e.vclock[e.name] {
+		e.lsn.Store(e.vclock[e.name])
+	}
+
+	e.history = newer
+	e.horizon = e.seq
+	e.horizonLSN = max(e.horizonLSN, snap.VClock[e.name])
+	e.horizonTime = time.Now().UnixNano()
+	return e.checkpoint()
+}
+
+// inbound is a message from a replica handed to the engine goroutine,
+// either a transaction or a snapshot. done is closed once it is handled.
+type inbound struct {
+	txn  *Transaction
+	snap *checkpointSnapshot
+	done chan struct{}
+}
+
+// dispatch passes a message read from a replica to the engine and waits
+// until it is handled. It returns the name of the node the message comes
+// from.
+func (e *Engine) dispatch(data []byte) (string, error) {
+	var head struct {
+		Action string `json:"action"`
+		Name   string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return "", err
+	}
+	in := &inbound{done: make(chan struct{})}
+	if head.Action == "snapshot" {
+		in.snap = &checkpointSnapshot{}
+		if err := json.Unmarshal(data, in.snap); err != nil {
+			return "", err
+		}
+	} else {
+		in.txn = &Transaction{}
+		if err := json.Unmarshal(data, in.txn); err != nil {
+			return "", err
+		}
+	}
+	select {
+	case e.inbox <- in:
+	case <-e.ctx.Done():
+		return head.Name, nil
+	}
+	select {
+	case <-in.done:
+	case <-e.ctx.Done():
+	}
+	return head.Name, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// ConflictPolicy is how concurrent changes of a feature made on different
+// nodes are resolved.
+type ConflictPolicy int
+
+const (
+	// ConflictLWW keeps the change with the latest hybrid logical clock,
+	// ties broken by node name. The losing change is only reported.
+	ConflictLWW ConflictPolicy = iota
+	// ConflictSiblings keeps all concurrent versions until the client writes
+	// a merged one. Reads by id answer 300 with all of them, selects return
+	// the one ConflictLWW would pick. Deletes are always resolved by LWW.
+	ConflictSiblings
+)
+
+// conflictLog is how many resolved conflicts are kept for the API.
+const conflictLog = 100
+
+// sibling is one of the concurrent versions of a feature.
+type sibling struct {
+	Name    string            `json:"name"`
+	HLC     uint64            `json:"hlc"`
+	Clock   map[string]uint64 `json:"clock"`
+	Version uint64            `json:"version"`
+	Feature *geojson.Feature  `json:"feature,omitempty"`
+}
+
+// resolution is a conflict resolved by ConflictLWW.
+type resolution struct {
+	ID     string   `json:"id"`
+	Winner *sibling `json:"winner"`
+	Loser  *sibling `json:"loser"`
+	At     string   `json:"at"`
+}
+
+// WithConflictPolicy sets how concurrent changes of a feature are resolved,
+// ConflictLWW by default.
+func WithConflictPolicy(policy ConflictPolicy) StorageOption {
+	return func(s *Storage) {
+		s.eng.policy = policy
+	}
+}
+
+// ordering is how two version vectors relate.
+type ordering int
+
+const (
+	equal ordering = iota
+	before
+	after
+	concurrent
+)
+
+// compare tells whether the version vector a is before, after, equal to
+// or concurrent with b.
+func compare(a, b map[string]uint64) ordering {
+	less, greater := false, false
+	for name := range merge(a, b) {
+		switch {
+		case a[name] < b[name]:
+			less = true
+		case a[name] > b[name]:
+			greater = true
+		}
+	}
+	switch {
+	case less && greater:
+		return concurrent
+	case less:
+		return before
+	case greater:
+		return after
+	}
+	return equal
+}
+
+// merge returns the version vector that has the changes of both.
+func merge(a, b map[string]uint64) map[string]uint64 {
+	out := maps.Clone(a)
+	if out == nil {
+		out = make(map[string]uint64, len(b))
+	}
+	for name, n := range b {
+		out[name] = max(out[name], n)
+	}
+	return out
+}
+
+// now returns a new hybrid logical clock: unix milliseconds in the high
+// bits and a counter in the low 16 bits, never going backwards. The caller
+// holds e.mu.
+func (e *Engine) now() uint64 {
+	e.hlc = max(uint64(time.Now().UnixMilli())<<16, e.hlc+1)
+	return e.hlc
+}
+
+// newer reports whether a wins over b under last-writer-wins.
+func newer(a, b *sibling) bool {
+	if a.HLC != b.HLC {
+		return a.HLC > b.HLC
+	}
+	return a.Name > b.Name
+}
+
+// merged returns the version vector of the record with all its siblings.
+func (rec *record) merged() map[string]uint64 {
+	clock := rec.clock
+	for _, s := range rec.siblings {
+		clock = merge(clock, s.Clock)
+	}
+	return clock
+}
+
+func (rec *record) sibling() *sibling {
+	return &sibling{Name: rec.name, HLC: rec.hlc, Clock: rec.clock, Version: rec.version, Feature: rec.feature}
+}
+
+// current returns the record of a feature, live or in the trash, and
+// whether it is deleted.
+func (e *Engine) current(id string) (*record, bool) {
+	if rec, exists := e.primary[id]; exists {
+		return rec, false
+	}
+	if t, trashed := e.trash[id]; trashed {
+		return &t.record, true
+	}
+	return nil, false
+}
+
+// stamp sets the version vector and hybrid logical clock of a local change:
+// it comes after the stored version and all its siblings. The caller holds
+// e.mu.
+func (e *Engine) stamp(txn *Transaction) {
+	clock := map[string]uint64{}
+	if cur, _ := e.current(txn.Feature.ID.(string)); cur != nil {
+		clock = merge(clock, cur.merged())
+	}
+	clock[e.name] = txn.LSN
+	txn.Clock = clock
+	txn.HLC = e.now()
+}
+
+// resolve decides what a change does to the stored record of its feature.
+// It returns the record to store, or false when the change is dropped:
+// it is older than the stored version or lost to it. Concurrent changes are
+// resolved by the conflict policy.
+func (e *Engine) resolve(id string, txn *Transaction, rec *record) (*record, bool) {
+	cur, deleted := e.current(id)
+	if cur == nil || cur.clock == nil || txn.Clock == nil {
+		return rec, true
+	}
+	switch compare(txn.Clock, cur.merged()) {
+	case after:
+		return rec, true
+	case before, equal:
+		return nil, false
+	}
+
+	clock := merge(cur.merged(), txn.Clock)
+	incoming := rec.sibling()
+	if e.policy == ConflictSiblings && !deleted && txn.Action != "delete" {
+		versions := []*sibling{incoming}
+		for _, s := range append([]*sibling{cur.sibling()}, cur.siblings...) {
+			if compare(s.Clock, txn.Clock) != before {
+				versions = append(versions, s)
+			}
+		}
+		slices.SortFunc(versions, func(a, b *sibling) int {
+			return cmp.Or(-cmp.Compare(a.HLC, b.HLC), -cmp.Compare(a.Name, b.Name))
+		})
+		w := versions[0]
+		slog.Info("conflict kept as siblings", slog.String("id", id), slog.Int("versions", len(versions)))
+		return &record{feature: w.Feature, version: w.Version, clock: w.Clock, hlc: w.HLC, name: w.Name, siblings: versions[1:]}, true
+	}
+
+	existing := cur.sibling()
+	winner, loser := existing, incoming
+	if newer(incoming, existing) {
+		winner, loser = incoming, existing
+	}
+	e.resolved = append(e.resolved, &resolution{ID: id, Winner: winner, Loser: loser, At: time.Now().UTC().Format(time.RFC3339Nano)})
+	if len(e.resolved) > conflictLog {
+		e.resolved = slices.Delete(e.resolved, 0, len(e.resolved)-conflictLog)
+	}
+	slog.Info("conflict resolved by last writer", slog.String("id", id), slog.String("winner", winner.Name))
+	if winner == incoming {
+		rec.clock = clock
+		return rec, true
+	}
+	cur.clock = clock
+	return nil, false
+}
+
+// conflicts returns the features with siblings, by id, and the conflicts
+// resolved by last-writer-wins, oldest first.
+func (e *Engine) conflicts() (map[string][]*sibling, []*resolution) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	siblings := make(map[string][]*sibling)
+	for id, rec := range e.primary {
+		if len(rec.siblings) > 0 {
+			siblings[id] = append([]*sibling{rec.sibling()}, rec.siblings...)
+		}
+	}
+	return siblings, append([]*resolution{}, e.resolved...)
+}
+
+// writeSiblings answers a read of a feature with concurrent versions with
+// 300 and all of them as a feature collection, the winner first. Their
+// nodes and clocks are in the "siblings" member. Writing the merged feature
+// resolves the conflict.
+func writeSiblings(w http.ResponseWriter, rec *record) {
+	versions := append([]*sibling{rec.sibling()}, rec.siblings...)
+	col := geojson.NewFeatureCollection()
+	meta := make([]map[string]any, 0, len(versions))
+	for _, s := range versions {
+		col.Append(s.Feature)
+		meta = append(meta, map[string]any{"name": s.Name, "hlc": s.HLC, "clock": s.Clock, "version": s.Version})
+	}
+	col.ExtraMembers = geojson.Properties{"siblings": meta}
+	data, err := col.MarshalJSON()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMultipleChoices)
+	w.Write(data)
+}
+
+// conflictsHandler lists the features with concurrent versions to merge and
+// the latest conflicts resolved by last-writer-wins.
+func (s *Storage) conflictsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("conflicts method")
+	siblings, resolved := s.eng.conflicts()
+	policy := "lww"
+	if s.eng.policy == ConflictSiblings {
+		policy = "siblings"
+	}
+	writeJSON(w, map[string]any{
+		"policy":   policy,
+		"siblings": siblings,
+		"resolved": resolved,
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// tokenHeader carries the consistency token of a write in the response,
+	// and may carry one in a read request instead of the token parameter.
+	tokenHeader = "X-Consistency-Token"
+	// tokenWait is how long a read waits for the Storage to apply the write
+	// of its token before the read is redirected.
+	tokenWait = time.Second
+)
+
+var errInvalidToken = errors.New("invalid consistency token")
+
+// consistencyToken names a write by the node that made it and its LSN. A
+// read with the token only sees a state that includes the write.
+type consistencyToken struct {
+	name string
+	lsn  uint64
+}
+
+func (t consistencyToken) String() string {
+	return t.name + ":" + strconv.FormatUint(t.lsn, 10)
+}
+
+func parseToken(raw string) (*consistencyToken, error) {
+	i := strings.LastIndexByte(raw, ':')
+	if i <= 0 {
+		return nil, errInvalidToken
+	}
+	lsn, err := strconv.ParseUint(raw[i+1:], 10, 64)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	return &consistencyToken{name: raw[:i], lsn: lsn}, nil
+}
+
+// readToken returns the consistency token of a read request, nil if it
+// doesn't have one.
+func readToken(r *http.Request) (*consistencyToken, error) {
+	raw := r.URL.Query().Get("token")
+	if raw == "" {
+		raw = r.Header.Get(tokenHeader)
+	}
+	if raw == "" {
+		return nil, nil
+	}
+	return parseToken(raw)
+}
+
+// covered reports whether the write of the token is in the vector clock. A
+// nil token is always covered.
+func (t *consistencyToken) covered(vclock map[string]uint64) bool {
+	return t == nil || vclock[t.name] >= t.lsn
+}
+
+// reach waits until the write of the token is applied or the timeout
+// expires.
+func (e *Engine) reach(t *consistencyToken, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		e.mu.Lock()
+		ok := t.covered(e.vclock)
+		wake := e.progress
+		e.mu.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-wake:
+		case <-deadline.C:
+			return false
+		case <-e.ctx.Done():
+			return false
+		}
+	}
+}
+
+// consistent wraps the select handler for reads with a consistency token.
+// The read waits until the Storage has the write, and is otherwise
+// redirected to a replica that has it, or to the leader.
+func (s *Storage) consistent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := readToken(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if token == nil || s.eng.reach(token, tokenWait) {
+			next(w, r)
+			return
+		}
+
+		query := r.URL.Query()
+		hops, _ := strconv.Atoi(query.Get("hops"))
+		var visited []string
+		if v := query.Get("visited"); v != "" {
+			visited = strings.Split(v, ",")
+		}
+		visited = append(visited, s.name)
+		target := ""
+		if status := s.pick(visited, token, 0, false, false); status != nil {
+			target = status.addr
+		} else if leader, addr := s.eng.role(); !leader && addr != "" {
+			target = addr
+		}
+		if target == "" || hops >= maxHops {
+			http.Error(w, "consistency token not reached: "+token.String(), http.StatusServiceUnavailable)
+			return
+		}
+		query.Set("hops", strconv.Itoa(hops+1))
+		query.Set("visited", strings.Join(visited, ","))
+		query.Set("token", token.String())
+		slog.Info("redirecting read behind its token", slog.String("storage", s.name), slog.String("token", token.String()))
+		http.Redirect(w, r, strings.TrimSuffix(target, "/")+"/select?"+query.Encode(), http.StatusTemporaryRedirect)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// heartbeatInterval is how often the leader reaches out to followers.
+	heartbeatInterval = 50 * time.Millisecond
+	// electionTimeout is how long a follower waits for the leader before it
+	// starts an election, and how long a leader keeps its lease without
+	// hearing from a majority. Followers add up to the same again at random,
+	// so they don't all campaign at once.
+	electionTimeout = 500 * time.Millisecond
+)
+
+var electionClient = &http.Client{Timeout: 4 * heartbeatInterval}
+
+// termState is the election state that has to survive restarts: a node
+// votes once per term, and a new leader's fence must not be forgotten.
+type termState struct {
+	Term     uint64            `json:"term"`
+	VotedFor string            `json:"votedFor,omitempty"`
+	Fence    map[string]uint64 `json:"fence,omitempty"`
+}
+
+type voteRequest struct {
+	Term      uint64            `json:"term"`
+	Candidate string            `json:"candidate"`
+	LastTerm  uint64            `json:"lastTerm"`
+	VClock    map[string]uint64 `json:"vclock"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// heartbeat is sent by the leader. Fence is the vector clock the leader had
+// when it was elected: transactions of earlier terms past it never reached
+// the leader and are dropped everywhere.
+type heartbeat struct {
+	Term   uint64            `json:"term"`
+	Leader string            `json:"leader"`
+	Addr   string            `json:"addr"`
+	Fence  map[string]uint64 `json:"fence"`
+}
+
+type heartbeatResponse struct {
+	Term uint64 `json:"term"`
+	OK   bool   `json:"ok"`
+}
+
+// loadTerm reads the election state saved by saveTerm.
+func (e *Engine) loadTerm() error {
+	data, err := os.ReadFile(e.termPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var state termState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	e.term = state.Term
+	e.votedFor = state.VotedFor
+	e.fence = state.Fence
+	return nil
+}
+
+// saveTerm persists the election state. The caller holds e.mu.
+func (e *Engine) saveTerm() error {
+	data, err := json.Marshal(&termState{Term: e.term, VotedFor: e.votedFor, Fence: e.fence})
+	if err != nil {
+		return err
+	}
+	tmp := e.termPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.termPath)
+}
+
+// fenced reports whether a transaction was made by a deposed leader and never
+// reached the leader that replaced it.
+func (e *Engine) fenced(txn *Transaction) bool {
+	return txn.Term < e.term && e.fence != nil && txn.LSN > e.fence[txn.Name]
+}
+
+// covers reports whether the vector clock a has every transaction of b,
+// ignoring the node named skip.
+func covers(a, b map[string]uint64, skip string) bool {
+	for name, lsn := range b {
+		if name != skip && lsn > a[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// follow makes the engine a follower in term. The caller holds e.mu.
+func (e *Engine) follow(term uint64) {
+	if term > e.term {
+		e.term = term
+		e.votedFor = ""
+	}
+	if e.leader {
+		slog.Info("stepping down", slog.String("name", e.name), slog.Uint64("term", e.term))
+	}
+	e.leader = false
+	e.leaderAddr = ""
+}
+
+// resync drops the connections to replicas, so they are made again and the
+// handshake ships a snapshot of the leader's state. The caller holds e.mu.
+func (e *Engine) resync() {
+	close(e.redial)
+	e.redial = make(chan struct{})
+}
+
+// elect runs the election until the engine is stopped: followers campaign
+// when the leader is silent, the leader sends heartbeats.
+func (e *Engine) elect() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	e.mu.Lock()
+	e.lastContact = time.Now()
+	e.mu.Unlock()
+	for {
+		select {
+		case <-ticker.C:
+			e.mu.Lock()
+			leader := e.leader
+			silent := time.Since(e.lastContact) > e.timeout
+			e.mu.Unlock()
+			switch {
+			case leader:
+				e.heartbeat()
+			case silent:
+				e.campaign()
+			}
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// majority is how many nodes of the replica set, this one included, make a
+// quorum.
+func (e *Engine) majority() int {
+	return (len(e.replicas)+1)/2 + 1
+}
+
+// broadcastRPC posts req to the endpoint of every replica and decodes the
+// answers of those that respond.
+func broadcastRPC[T any](replicas []string, endpoint string, req any) []T {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil
+	}
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		out []T
+	)
+	for _, addr := range replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := electionClient.Post(strings.TrimSuffix(addr, "/")+endpoint, "application/json", bytes.NewReader(body))
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+			var v T
+			if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&v) != nil {
+				return
+			}
+			mu.Lock()
+			out = append(out, v)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return out
+}
+
+// campaign starts a new term and asks the replicas for their votes.
+func (e *Engine) campaign() {
+	e.mu.Lock()
+	e.follow(e.term + 1)
+	e.votedFor = e.name
+	e.lastContact = time.Now()
+	e.timeout = electionTimeout + rand.N(electionTimeout)
+	req := &voteRequest{Term: e.term, Candidate: e.name, LastTerm: e.lastTerm, VClock: maps.Clone(e.vclock)}
+	if err := e.saveTerm(); err != nil {
+		slog.Error("can't save term", slog.String("error", err.Error()))
+		e.mu.Unlock()
+		return
+	}
+	e.mu.Unlock()
+	slog.Info("starting election", slog.String("name", e.name), slog.Uint64("term", req.Term))
+
+	votes := 1
+	for _, resp := range broadcastRPC[voteResponse](e.replicas, "/vote", req) {
+		if resp.Granted {
+			votes++
+		}
+		if resp.Term > req.Term {
+			e.mu.Lock()
+			e.follow(resp.Term)
+			e.saveTerm()
+			e.mu.Unlock()
+			return
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if votes < e.majority() || e.term != req.Term || e.votedFor != e.name {
+		return
+	}
+	e.leader = true
+	e.leaderAddr = e.addr
+	e.leaderName = e.name
+	e.lastQuorum = time.Now()
+	e.fence = make(map[string]uint64, len(e.vclock))
+	for name, lsn := range e.vclock {
+		e.fence[name] = lsn
+	}
+	if err := e.saveTerm(); err != nil {
+		slog.Error("can't save term", slog.String("error", err.Error()))
+	}
+	slog.Info("elected leader", slog.String("name", e.name), slog.Uint64("term", e.term), slog.Int("votes", votes))
+}
+
+// heartbeat asserts the leadership to the replicas. A leader that hasn't
+// heard from a majority for the election timeout steps down, since another
+// one may have been elected meanwhile.
+func (e *Engine) heartbeat() {
+	e.mu.Lock()
+	hb := &heartbeat{Term: e.term, Leader: e.name, Addr: e.addr, Fence: e.fence}
+	e.mu.Unlock()
+
+	acks := 1
+	var newer uint64
+	for _, resp := range broadcastRPC[heartbeatResponse](e.replicas, "/heartbeat", hb) {
+		if resp.OK {
+			acks++
+		}
+		newer = max(newer, resp.Term)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.term != hb.Term || !e.leader {
+		return
+	}
+	switch {
+	case newer > e.term:
+		e.follow(newer)
+		e.saveTerm()
+	case acks >= e.majority():
+		e.lastQuorum = time.Now()
+	case time.Since(e.lastQuorum) > electionTimeout:
+		slog.Info("lost the quorum", slog.String("name", e.name))
+		e.follow(e.term)
+		e.lastContact = time.Now()
+	}
+}
+
+// vote answers a candidate. The vote is granted once per term, and only to
+// candidates at least as up to date as this node: with a newer last term,
+// or the same one and every transaction this node applied.
+func (e *Engine) vote(req *voteRequest) *voteResponse {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if req.Term > e.term {
+		e.follow(req.Term)
+	}
+	upToDate := req.LastTerm > e.lastTerm || (req.LastTerm == e.lastTerm && covers(req.VClock, e.vclock, ""))
+	granted := req.Term == e.term && (e.votedFor == "" || e.votedFor == req.Candidate) && upToDate
+	if granted {
+		e.votedFor = req.Candidate
+		e.lastContact = time.Now()
+	}
+	if err := e.saveTerm(); err != nil {
+		slog.Error("can't save term", slog.String("error", err.Error()))
+		granted = false
+	}
+	return &voteResponse{Term: e.term, Granted: granted}
+}
+
+// follower accepts a heartbeat of the leader of the current or a newer term.
+// A node that learns about a new term while holding transactions past the
+// fence, its own as a deposed leader or others it got from one, resyncs
+// from the new leader.
+func (e *Engine) follower(hb *heartbeat) *heartbeatResponse {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if hb.Term < e.term {
+		return &heartbeatResponse{Term: e.term}
+	}
+	newTerm := hb.Term > e.term || e.leader
+	e.follow(hb.Term)
+	e.leaderAddr = hb.Addr
+	e.leaderName = hb.Leader
+	e.lastContact = time.Now()
+	e.fence = hb.Fence
+	if newTerm {
+		if err := e.saveTerm(); err != nil {
+			slog.Error("can't save term", slog.String("error", err.Error()))
+			return &heartbeatResponse{Term: e.term}
+		}
+		if !covers(hb.Fence, e.vclock, hb.Leader) {
+			slog.Info("holding fenced transactions, resyncing", slog.String("name", e.name), slog.Uint64("term", e.term))
+			e.resync()
+		}
+	}
+	return &heartbeatResponse{Term: e.term, OK: true}
+}
+
+func (s *Storage) voteHandler(w http.ResponseWriter, r *http.Request) {
+	var req voteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, s.eng.vote(&req))
+}
+
+func (s *Storage) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	var hb heartbeat
+	if err := json.NewDecoder(r.Body).Decode(&hb); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, s.eng.follower(&hb))
+}
@@ -1,3 +1,23 @@
 module practice2
 
 go 1.23.5
+
+require (
+	github.com/evanphx/json-patch/v5 v5.9.11
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/json-iterator/go v1.1.12
+	github.com/paulmach/orb v0.11.1
+	github.com/stretchr/testify v1.10.0
+	github.com/tidwall/rtree v1.10.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/tidwall/geoindex v1.7.0 // indirect
+	go.mongodb.org/mongo-driver v1.11.4 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
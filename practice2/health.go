@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// maxHealthyLag is how many transactions a replica may miss before the
+	// Storage reports itself degraded.
+	maxHealthyLag = 1000
+	// downAfter failures in a row take a node out of rotation, upAfter
+	// successes in a row bring it back, so a flapping node stays out.
+	downAfter = 3
+	upAfter   = 2
+	// defaultHealthInterval is how often the Router checks every node.
+	defaultHealthInterval = 5 * time.Second
+)
+
+// The health of a Storage: degraded ones still serve, failing ones answer
+// 503 to health checks.
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFailing  = "failing"
+)
+
+// probeDisk checks that the log can be written: the log file is open and
+// a file can be synced next to it. The probe is unlinked as soon as it is
+// made, so that a process stopped meanwhile doesn't leave it behind.
+func (e *Engine) probeDisk() error {
+	e.mu.Lock()
+	_, err := e.logFile.Stat()
+	name := e.logFile.Name()
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(filepath.Dir(name), ".health-*")
+	if err != nil {
+		return err
+	}
+	defer probe.Close()
+	if err := os.Remove(probe.Name()); err != nil {
+		return err
+	}
+	if _, err := probe.WriteString("ok"); err != nil {
+		return err
+	}
+	return probe.Sync()
+}
+
+// replicaLag returns how many transactions of this Storage every replica
+// it sends them to has yet to persist.
+func (e *Engine) replicaLag() map[string]uint64 {
+	lsn := e.lsn.Load()
+	e.peersMu.Lock()
+	defer e.peersMu.Unlock()
+	lags := make(map[string]uint64, len(e.peers))
+	for name := range e.peers {
+		lags[name] = lsn - min(e.acks[name], lsn)
+	}
+	return lags
+}
+
+// healthHandler reports the state of the engine, the lag of the replicas
+// and whether the disk takes writes. It answers 503 when the Storage is
+// failing, so that plain HTTP checks see it.
+func (s *Storage) healthHandler(w http.ResponseWriter, r *http.Request) {
+	leader, addr := s.eng.role()
+	role := "follower"
+	if leader {
+		role = "leader"
+	}
+	status, engine := healthOK, "running"
+	if s.eng.ctx.Err() != nil {
+		status, engine = healthFailing, "stopped"
+	}
+	disk := map[string]any{"ok": true}
+	if err := s.eng.probeDisk(); err != nil {
+		status = healthFailing
+		disk = map[string]any{"ok": false, "error": err.Error()}
+	}
+	lags := s.eng.replicaLag()
+	for _, n := range lags {
+		if n > maxHealthyLag && status == healthOK {
+			status = healthDegraded
+		}
+	}
+	if !leader && addr == "" && status == healthOK {
+		// a follower without a leader can't take writes
+		status = healthDegraded
+	}
+	data, err := json.Marshal(map[string]any{
+		"name":   s.name,
+		"status": status,
+		"engine": engine,
+		"role":   role,
+		"leader": addr,
+		"lsn":    s.eng.lsn.Load(),
+		"lag":    lags,
+		"disk":   disk,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status == healthFailing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.Write(data)
+}
+
+// nodeState is what the Router knows of the health of a Storage, from the
+// requests it made to it and from its health checks.
+type nodeState struct {
+	Healthy   bool            `json:"healthy"`
+	Failures  int             `json:"failures"`
+	Successes int             `json:"successes"`
+	LastError string          `json:"lastError,omitempty"`
+	Since     time.Time       `json:"since"`
+	Report    json.RawMessage `json:"report,omitempty"`
+}
+
+// WithHealthChecks sets how often the Router checks the health of every
+// node of the routing table, defaultHealthInterval by default. Zero turns
+// them off, nodes are then only judged by the requests made to them.
+func WithHealthChecks(interval time.Duration) RouterOption {
+	return func(r *Router) {
+		r.healthInterval = interval
+	}
+}
+
+// nodeOf returns the node a request goes to: the address of a Storage,
+// like http://127.0.0.1:8080/storage or /storage.
+func nodeOf(u *url.URL) string {
+	name, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if u.Host == "" {
+		return "/" + name
+	}
+	return u.Scheme + "://" + u.Host + "/" + name
+}
+
+// observe counts the outcome of a request to a node, a failure if err is
+// set, and takes the node out of rotation or back in.
+func (r *Router) observe(addr string, err error) {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+	n, ok := r.nodes[addr]
+	if !ok {
+		n = &nodeState{Healthy: true, Since: time.Now()}
+		r.nodes[addr] = n
+	}
+	if err != nil {
+		n.Failures++
+		n.Successes = 0
+		n.LastError = err.Error()
+		if n.Healthy && n.Failures >= downAfter {
+			n.Healthy, n.Since = false, time.Now()
+			slog.Warn("node out of rotation", slog.String("node", addr), slog.String("error", n.LastError))
+		}
+		return
+	}
+	n.Successes++
+	n.Failures = 0
+	if !n.Healthy && n.Successes >= upAfter {
+		n.Healthy, n.Since = true, time.Now()
+		slog.Info("node back in rotation", slog.String("node", addr))
+	}
+}
+
+// healthy reports whether the node is in rotation. Nodes not heard of yet
+// are.
+func (r *Router) healthy(addr string) bool {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+	n, ok := r.nodes[addr]
+	return !ok || n.Healthy
+}
+
+// live returns the node to send the requests of the shard led by addr to:
+// the leader while it is healthy, else the first healthy replica, which
+// serves reads and redirects writes to the leader it knows.
+func (r *Router) live(addr string) string {
+	if r.healthy(addr) {
+		return addr
+	}
+	for _, shard := range r.routes().Shards() {
+		if shard.LeaderAddr != addr {
+			continue
+		}
+		for _, replica := range shard.Replicas {
+			if r.healthy(replica) {
+				return replica
+			}
+		}
+	}
+	return addr
+}
+
+// observedTransport reports the outcome of every request of the Router to
+// a Storage: network errors, 502 and 504 are failures. Requests the client
+// gave up on tell nothing.
+type observedTransport struct {
+	r    *Router
+	next http.RoundTripper
+}
+
+func (t *observedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case errors.Is(err, context.Canceled):
+	case err != nil:
+		t.r.observe(nodeOf(req.URL), err)
+	case resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusGatewayTimeout:
+		t.r.observe(nodeOf(req.URL), errors.New(resp.Status))
+	default:
+		t.r.observe(nodeOf(req.URL), nil)
+	}
+	return resp, err
+}
+
+// tableNodes returns the leaders and replicas of every shard.
+func tableNodes(table *RoutingTable) []string {
+	var nodes []string
+	for _, shard := range table.Shards() {
+		nodes = append(nodes, shard.LeaderAddr)
+		nodes = append(nodes, shard.Replicas...)
+	}
+	return nodes
+}
+
+// check asks a node for its health and keeps the report.
+func (r *Router) check(ctx context.Context, addr string) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(addr, "/")+"/health", nil)
+	if err != nil {
+		return
+	}
+	resp, err := r.checkClient.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			r.observe(addr, err)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		r.observe(addr, fmt.Errorf("health check: %s", resp.Status))
+	} else {
+		r.observe(addr, nil)
+	}
+	if json.Valid(data) {
+		r.healthMu.Lock()
+		r.nodes[addr].Report = data
+		r.healthMu.Unlock()
+	}
+}
+
+// checkHealth checks every node of the routing table in every interval
+// until the Router stops.
+func (r *Router) checkHealth() {
+	if r.healthInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.healthInterval)
+	defer ticker.Stop()
+	for {
+		for _, addr := range tableNodes(r.routes()) {
+			r.check(r.ctx, addr)
+		}
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// clusterHandler answers with the shards, the node each one is routed to,
+// and the health of every node.
+func (r *Router) clusterHandler(w http.ResponseWriter, req *http.Request) {
+	table := r.routes()
+	type clusterShard struct {
+		LeaderAddr string   `json:"leaderAddr"`
+		Replicas   []string `json:"replicas"`
+		RouteTo    string   `json:"routeTo"`
+	}
+	shards := []clusterShard{}
+	for _, shard := range table.Shards() {
+		shards = append(shards, clusterShard{LeaderAddr: shard.LeaderAddr, Replicas: shard.Replicas, RouteTo: r.live(shard.LeaderAddr)})
+	}
+	nodes := map[string]nodeState{}
+	r.healthMu.Lock()
+	for _, addr := range tableNodes(table) {
+		if n, ok := r.nodes[addr]; ok {
+			nodes[addr] = *n
+		} else {
+			nodes[addr] = nodeState{Healthy: true}
+		}
+	}
+	r.healthMu.Unlock()
+	cluster := map[string]any{"shards": shards, "nodes": nodes}
+	if r.meta != nil {
+		cluster["version"], _ = r.meta.current()
+	}
+	writeJSON(w, cluster)
+}
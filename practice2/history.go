@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+var errHistoryGone = errors.New("requested version is older than the retained history")
+
+// checkpointHeader is the first line of a checkpoint file. Checkpoints
+// written before it was introduced start right away with insert
+// transactions.
+type checkpointHeader struct {
+	Action      string            `json:"action"`
+	LSN         uint64            `json:"lsn"`
+	LastTerm    uint64            `json:"lastTerm,omitempty"`
+	VClock      map[string]uint64 `json:"vclock,omitempty"`
+	Seq         uint64            `json:"seq,omitempty"`
+	Horizon     uint64            `json:"horizon"`
+	HorizonLSN  uint64            `json:"horizonLSN,omitempty"`
+	HorizonTime int64             `json:"horizonTime"`
+}
+
+// sequence gives a record read back from the log or the history file its
+// Seq, if it was written without one, and keeps seq past it.
+func (e *Engine) sequence(txn *Transaction) {
+	if txn.Seq == 0 {
+		txn.Seq = e.seq + 1
+	}
+	e.seq = max(e.seq, txn.Seq)
+}
+
+// retain drops log records older than the retention period from the
+// history. The state of the map is then only known from the horizon on:
+// the Seq of the newest dropped record. For every feature changed after the
+// horizon the last image before it is kept, so the feature can still be
+// reconstructed as of the horizon. The local changes are only all there
+// after horizonLSN, the LSN of the newest local record dropped.
+func (e *Engine) retain(now time.Time) {
+	cutoff := now.Add(-e.retention).UnixNano()
+	// a migration still has to read the local changes after its hold
+	floor, held := e.held(now)
+	expired := func(txn *Transaction) bool {
+		return txn.Time < cutoff && !(held && txn.Name == e.name && txn.LSN > floor)
+	}
+	before := make(map[string]*Transaction)
+	changed := make(map[string]bool)
+	for _, txn := range e.history {
+		id := txn.Feature.ID.(string)
+		if expired(txn) {
+			before[id] = txn
+			e.horizon = max(e.horizon, txn.Seq)
+			if txn.Name == e.name {
+				e.horizonLSN = max(e.horizonLSN, txn.LSN)
+			}
+		} else {
+			changed[id] = true
+		}
+	}
+	if len(before) == 0 {
+		return
+	}
+	e.horizonTime = max(e.horizonTime, cutoff)
+
+	kept := e.history[:0]
+	for _, txn := range e.history {
+		id := txn.Feature.ID.(string)
+		if !expired(txn) || (before[id] == txn && changed[id] && !removed(txn)) {
+			kept = append(kept, txn)
+		}
+	}
+	clear(e.history[len(kept):])
+	e.history = kept
+}
+
+// loadHistory reads the history records moved out of the log by earlier
+// checkpoints.
+func (e *Engine) loadHistory() error {
+	file, err := os.Open(e.historyPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		var txn Transaction
+		if err := decoder.Decode(&txn); err != nil {
+			break
+		}
+		e.sequence(&txn)
+		e.history = append(e.history, &txn)
+	}
+	return nil
+}
+
+// saveHistory replaces the history file with the retained history.
+func (e *Engine) saveHistory() error {
+	tmp := e.historyPath + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, txn := range e.history {
+		if err := encoder.Encode(txn); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.historyPath)
+}
+
+// featureHistory returns the retained transactions of a feature, oldest
+// first.
+func (e *Engine) featureHistory(id string) []*Transaction {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var txns []*Transaction
+	for _, txn := range e.history {
+		if txn.Feature.ID == id {
+			txns = append(txns, txn)
+		}
+	}
+	return txns
+}
+
+// seqAt returns the Seq of the last transaction applied before the first
+// one made after t.
+func (e *Engine) seqAt(t time.Time) (uint64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ts := t.UnixNano()
+	if ts < e.horizonTime {
+		return 0, errHistoryGone
+	}
+	seq := e.seq
+	for _, txn := range e.history {
+		if txn.Time > ts {
+			seq = txn.Seq - 1
+			break
+		}
+	}
+	return max(seq, e.horizon), nil
+}
+
+// snapshot returns the features as they were right after the transaction
+// with the given Seq. Features not changed since then are taken from the
+// primary index, the others from the latest retained image at or before
+// seq.
+func (e *Engine) snapshot(seq uint64) (map[string]*geojson.Feature, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if seq < e.horizon {
+		return nil, errHistoryGone
+	}
+	features := make(map[string]*geojson.Feature, len(e.primary))
+	for id, rec := range e.primary {
+		features[id] = rec.feature
+	}
+	latest := make(map[string]*Transaction)
+	changed := make(map[string]bool)
+	for _, txn := range e.history {
+		id := txn.Feature.ID.(string)
+		if txn.Seq <= seq {
+			latest[id] = txn
+		} else {
+			changed[id] = true
+		}
+	}
+	for id := range changed {
+		delete(features, id)
+		if txn, ok := latest[id]; ok && !removed(txn) {
+			features[id] = txn.Feature
+		}
+	}
+	return features, nil
+}
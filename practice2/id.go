@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/paulmach/orb/geojson"
+)
+
+// IDPolicy controls which feature IDs a Storage accepts on insert.
+type IDPolicy int
+
+const (
+	// IDGenerate accepts string and integer IDs and generates a UUIDv7
+	// when the ID is missing.
+	IDGenerate IDPolicy = iota
+	// IDRequire accepts string and integer IDs and rejects features
+	// without one.
+	IDRequire
+	// IDUUID accepts only UUID strings and generates a UUIDv7 when the ID
+	// is missing.
+	IDUUID
+)
+
+var (
+	errMissingID = errors.New("feature id is missing")
+	errInvalidID = errors.New("feature id must be a string or an integer")
+	errNotUUID   = errors.New("feature id must be a uuid")
+	errReserved  = errors.New("feature id is reserved")
+)
+
+// newID returns a time-ordered UUIDv7, so that generated IDs sort in
+// insertion order.
+func newID() string {
+	return uuid.Must(uuid.NewV7()).String()
+}
+
+// sequenceID returns the UUIDv7 of the nth feature of a named sequence
+// started at the given time. The same arguments make the same id, and the
+// ids of a sequence sort by n: n takes the counter bits of the UUID, a hash
+// of the name the rest of the random bits.
+func sequenceID(name string, at time.Time, n int) string {
+	var id uuid.UUID
+	ms := uint64(at.UnixMilli())
+	for i := range 6 {
+		id[i] = byte(ms >> (40 - 8*i))
+	}
+	counter := uint16(n>>30) & 0x0fff
+	id[6] = 0x70 | byte(counter>>8)
+	id[7] = byte(counter)
+	sum := sha256.Sum256([]byte(name))
+	low := uint64(n&(1<<30-1))<<32 | uint64(binary.BigEndian.Uint32(sum[:4]))
+	binary.BigEndian.PutUint64(id[8:], 1<<63|low)
+	return id.String()
+}
+
+// parseID converts a decoded JSON ID into its canonical string form.
+// Integer numbers are formatted in decimal, anything else but a non-empty
+// string is rejected.
+func parseID(raw any) (string, error) {
+	switch id := raw.(type) {
+	case nil:
+		return "", errMissingID
+	case string:
+		if id == "" {
+			return "", errMissingID
+		}
+		return id, nil
+	case float64:
+		if id != math.Trunc(id) || math.Abs(id) > 1<<53 {
+			return "", errInvalidID
+		}
+		return strconv.FormatInt(int64(id), 10), nil
+	case json.Number:
+		if _, err := id.Int64(); err != nil {
+			return "", errInvalidID
+		}
+		return id.String(), nil
+	default:
+		return "", errInvalidID
+	}
+}
+
+// featureID is parseID for the feature handlers of a Storage. A metadata
+// Storage also rejects the id its routing table is kept under.
+func (s *Storage) featureID(raw any) (string, error) {
+	id, err := parseID(raw)
+	if err == nil && s.metadata && id == routingFeature {
+		return "", errReserved
+	}
+	return id, err
+}
+
+// assignID validates the ID of a feature being inserted according to the
+// policy of the Storage, generating one when allowed, and stores the
+// canonical string form back into feature.ID.
+func (s *Storage) assignID(feature *geojson.Feature) (string, error) {
+	id, err := s.featureID(feature.ID)
+	switch {
+	case errors.Is(err, errMissingID) && s.idPolicy != IDRequire:
+		id = newID()
+	case err != nil:
+		return "", err
+	case s.idPolicy == IDUUID:
+		if _, err := uuid.Parse(id); err != nil {
+			return "", errNotUUID
+		}
+	}
+	feature.ID = id
+	return id, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+var errNotLeader = errors.New("only the leader accepts writes")
+
+// role reports whether the engine may create transactions, and the address
+// of the replica set leader if it may not.
+func (e *Engine) role() (leader bool, addr string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader, e.leaderAddr
+}
+
+// leaderOnly wraps a write handler. Followers redirect the request with 307
+// to the same endpoint of the leader, or answer 503 when the leader is not
+// known.
+func (s *Storage) leaderOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		leader, addr := s.eng.role()
+		if leader {
+			next(w, r)
+			return
+		}
+		if addr == "" {
+			writeError(w, errNotLeader)
+			return
+		}
+		slog.Info("forwarding write to leader", slog.String("storage", s.name), slog.String("leader", addr))
+		target := strings.TrimSuffix(addr, "/") + strings.TrimPrefix(r.URL.RequestURI(), "/"+s.name)
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+	}
+}
+
+// statusHandler reports the role of the Storage, the leader address, the
+// election term and what replicas balance reads by: the vector clock and
+// the reads in flight.
+func (s *Storage) statusHandler(w http.ResponseWriter, r *http.Request) {
+	leader, addr := s.eng.role()
+	s.eng.mu.Lock()
+	term := s.eng.term
+	s.eng.mu.Unlock()
+	role := "follower"
+	if leader {
+		role = "leader"
+	}
+	writeJSON(w, map[string]any{
+		"name":     s.name,
+		"role":     role,
+		"leader":   addr,
+		"term":     term,
+		"lsn":      s.eng.lsn.Load(),
+		"vclock":   s.eng.clock(),
+		"inflight": s.inflight.Load(),
+	})
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	// loadHalfLife is how long it takes past requests to count half as much
+	// in the load statistics.
+	loadHalfLife = time.Minute
+	// loadCell is the side, in degrees, of the cells Storages count their
+	// load in. Routers count it per sector of the routing table.
+	loadCell = 5.0
+	// minLoad is the rate under which a cell is forgotten.
+	minLoad = 1e-3
+)
+
+// decayRate is an exponentially decaying count of events: every event adds
+// to it, and it halves every loadHalfLife. Times ln 2 and divided by the
+// half-life it is the rate of the events per second.
+type decayRate struct {
+	value float64
+	at    time.Time
+}
+
+func (d *decayRate) add(n float64, now time.Time) {
+	d.value = d.decayed(now) + n
+	d.at = now
+}
+
+func (d *decayRate) decayed(now time.Time) float64 {
+	if d.at.IsZero() {
+		return 0
+	}
+	return d.value * math.Exp2(-now.Sub(d.at).Seconds()/loadHalfLife.Seconds())
+}
+
+// rate returns the events per second.
+func (d *decayRate) rate(now time.Time) float64 {
+	return d.decayed(now) * math.Ln2 / loadHalfLife.Seconds()
+}
+
+type loadKind int
+
+const (
+	loadRead loadKind = iota
+	loadWrite
+)
+
+type cellRates struct {
+	reads, writes, bytes decayRate
+}
+
+// cellLoad is the load of an area of the map: reads and writes per second,
+// and bytes written per second.
+type cellLoad struct {
+	Bound  [4]float64 `json:"bound"`
+	Reads  float64    `json:"reads"`
+	Writes float64    `json:"writes"`
+	Bytes  float64    `json:"bytes"`
+}
+
+// total is the requests per second.
+func (c cellLoad) total() float64 {
+	return c.Reads + c.Writes
+}
+
+// loadHistogram keeps the decaying load of areas of the map.
+type loadHistogram struct {
+	mu    sync.Mutex
+	cells map[[4]float64]*cellRates
+}
+
+func newLoadHistogram() *loadHistogram {
+	return &loadHistogram{cells: make(map[[4]float64]*cellRates)}
+}
+
+// record counts a request to the areas, with the bytes it wrote. A request
+// to several areas counts as a share of one in each, so a wide scan doesn't
+// look like load everywhere.
+func (h *loadHistogram) record(kind loadKind, bytes int, areas ...[4]float64) {
+	if len(areas) == 0 {
+		return
+	}
+	now := time.Now()
+	share := 1 / float64(len(areas))
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, area := range areas {
+		c, ok := h.cells[area]
+		if !ok {
+			c = &cellRates{}
+			h.cells[area] = c
+		}
+		if kind == loadRead {
+			c.reads.add(share, now)
+		} else {
+			c.writes.add(share, now)
+			c.bytes.add(float64(max(bytes, 0))*share, now)
+		}
+	}
+}
+
+// load returns the load of an area, zero if it has none.
+func (h *loadHistogram) load(area [4]float64) cellLoad {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := cellLoad{Bound: area}
+	if c, ok := h.cells[area]; ok {
+		out.Reads, out.Writes, out.Bytes = c.reads.rate(now), c.writes.rate(now), c.bytes.rate(now)
+	}
+	return out
+}
+
+// snapshot returns the load of the areas intersecting rect, all of them if
+// nil, busiest first. Areas whose load decayed away are forgotten.
+func (h *loadHistogram) snapshot(rect *orb.Bound) []cellLoad {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []cellLoad{}
+	for area, c := range h.cells {
+		load := cellLoad{Bound: area, Reads: c.reads.rate(now), Writes: c.writes.rate(now), Bytes: c.bytes.rate(now)}
+		if load.total() < minLoad && load.Bytes < minLoad {
+			delete(h.cells, area)
+			continue
+		}
+		if rect == nil || rect.Intersects(toBound(area)) {
+			out = append(out, load)
+		}
+	}
+	slices.SortFunc(out, func(a, b cellLoad) int {
+		return cmp.Or(cmp.Compare(b.total(), a.total()), slices.Compare(a.Bound[:], b.Bound[:]))
+	})
+	return out
+}
+
+// cellsOf returns the cells of loadCell degrees a bound overlaps.
+func cellsOf(bound orb.Bound) [][4]float64 {
+	index := func(v, origin, limit float64) int {
+		return min(max(int(math.Floor((v-origin)/loadCell)), 0), int((limit-origin)/loadCell)-1)
+	}
+	var cells [][4]float64
+	for x := index(bound.Min.X(), world.Min.X(), world.Max.X()); x <= index(bound.Max.X(), world.Min.X(), world.Max.X()); x++ {
+		for y := index(bound.Min.Y(), world.Min.Y(), world.Max.Y()); y <= index(bound.Max.Y(), world.Min.Y(), world.Max.Y()); y++ {
+			minX, minY := world.Min.X()+float64(x)*loadCell, world.Min.Y()+float64(y)*loadCell
+			cells = append(cells, [4]float64{minX, minY, minX + loadCell, minY + loadCell})
+		}
+	}
+	return cells
+}
+
+// occupied returns the cells of loadCell degrees intersecting rect that hold
+// features. The caller holds e.mu.
+func (e *Engine) occupied(rect orb.Bound) [][4]float64 {
+	var cells [][4]float64
+	for cell := range e.cells {
+		if rect.Intersects(toBound(cell)) {
+			cells = append(cells, cell)
+		}
+	}
+	return cells
+}
+
+// recordFeature counts a request for a feature in the cell of its center.
+func (s *Storage) recordFeature(kind loadKind, feature *geojson.Feature, bytes int) {
+	s.load.record(kind, bytes, cellOf(feature))
+}
+
+// cellSize is how many features have their center in a cell of loadCell
+// degrees, and how many bytes their records take in the log.
+type cellSize struct {
+	features int
+	bytes    int64
+}
+
+// cellOf returns the cell of loadCell degrees of the center of a feature.
+func cellOf(feature *geojson.Feature) [4]float64 {
+	center := feature.Geometry.Bound().Center()
+	return cellsOf(orb.Bound{Min: center, Max: center})[0]
+}
+
+// count adds a stored record to the size of its cell, or takes it away with
+// a negative sign. The routing table of a metadata Storage isn't counted.
+// The caller holds e.mu.
+func (e *Engine) count(rec *record, sign int) {
+	if e.keepsTable(rec.feature.ID) {
+		return
+	}
+	if sign > 0 && rec.size == 0 {
+		// records not read from the log, such as those of a snapshot
+		data, err := rec.feature.MarshalJSON()
+		if err != nil {
+			return
+		}
+		rec.size = int64(len(data))
+	}
+	cell := cellOf(rec.feature)
+	c, ok := e.cells[cell]
+	if !ok {
+		c = &cellSize{}
+		e.cells[cell] = c
+	}
+	c.features += sign
+	c.bytes += int64(sign) * rec.size
+	if c.features == 0 {
+		delete(e.cells, cell)
+	}
+}
+
+// size returns how many features have their center in rect, the whole map
+// if nil, and how many bytes their records take. Cells inside rect are counted
+// whole, the features of the others one by one. The caller holds e.mu.
+func (e *Engine) size(rect *orb.Bound) cellSize {
+	var total cellSize
+	for cell, c := range e.cells {
+		bound := toBound(cell)
+		switch {
+		case rect == nil || rect.Contains(bound.Min) && rect.Contains(bound.Max):
+			total.features += c.features
+			total.bytes += c.bytes
+		case rect.Intersects(bound):
+			lo := [2]float64{max(rect.Min.X(), bound.Min.X()), max(rect.Min.Y(), bound.Min.Y())}
+			hi := [2]float64{min(rect.Max.X(), bound.Max.X()), min(rect.Max.Y(), bound.Max.Y())}
+			e.spatial.Search(lo, hi, func(min, max [2]float64, data interface{}) bool {
+				rec := e.primary[data.(string)]
+				if rect.Contains(rec.feature.Geometry.Bound().Center()) && cellOf(rec.feature) == cell {
+					total.features++
+					total.bytes += rec.size
+				}
+				return true
+			})
+		}
+	}
+	return total
+}
+
+// statsHandler answers with the load of the cells of the Storage, and how
+// many features have their center in the rect parameter, the whole map if
+// not given, and how many bytes their records take.
+func (s *Storage) statsHandler(w http.ResponseWriter, r *http.Request) {
+	var rect *orb.Bound
+	if get := r.URL.Query().Get("rect"); get != "" {
+		bound, err := parseRect(get)
+		if err != nil {
+			http.Error(w, "invalid rect: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rect = &bound
+	}
+	s.eng.mu.Lock()
+	size := s.eng.size(rect)
+	s.eng.mu.Unlock()
+	writeJSON(w, map[string]any{
+		"name":     s.name,
+		"halfLife": loadHalfLife.String(),
+		"features": size.features,
+		"bytes":    size.bytes,
+		"cells":    s.load.snapshot(rect),
+	})
+}
+
+// SplitPolicy decides when the Router splits a hot sector: when its
+// requests per second, features or bytes cross a threshold, zero for none.
+// The Router checks the sectors every Interval and proposes the splits, or
+// runs them if Auto, one at a time. The half of a split sector with the
+// most requests on its shard goes to the least loaded other shard. Sectors
+// aren't split into halves narrower than MinSize degrees.
+type SplitPolicy struct {
+	MaxRate     float64
+	MaxFeatures int
+	MaxBytes    int64
+	Interval    time.Duration
+	Auto        bool
+	MinSize     float64
+}
+
+// WithSplitPolicy makes the Router check its sectors against the policy.
+func WithSplitPolicy(policy SplitPolicy) RouterOption {
+	return func(r *Router) {
+		r.policy = &policy
+	}
+}
+
+// splitProposal is a sector the policy would split, and why.
+type splitProposal struct {
+	Sector   [4]float64 `json:"sector"`
+	Shard    string     `json:"shard"`
+	To       string     `json:"to"`
+	Reason   string     `json:"reason"`
+	Rate     float64    `json:"rate"`
+	Features int        `json:"features"`
+	Bytes    int64      `json:"bytes"`
+}
+
+// sectorStats is what the shard of a sector says of the features in it, and
+// of the load of its cells.
+type sectorStats struct {
+	Features int        `json:"features"`
+	Bytes    int64      `json:"bytes"`
+	Cells    []cellLoad `json:"cells"`
+}
+
+// sectorSize asks the leader of a shard how many features a sector has.
+func (r *Router) sectorSize(ctx context.Context, shard *Shard, bound [4]float64) (*sectorStats, error) {
+	resp, err := r.fetch(ctx, "GET", shard.LeaderAddr+"/stats?"+url.Values{"rect": {formatBound(bound)}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{code: resp.StatusCode, body: string(data)}
+	}
+	var stats sectorStats
+	return &stats, json.Unmarshal(data, &stats)
+}
+
+// evaluate checks every sector against the policy and returns the splits
+// it proposes, hottest first.
+func (r *Router) evaluate(ctx context.Context) []splitProposal {
+	table := r.routes()
+	// forgets the sectors split or merged since
+	r.load.snapshot(nil)
+	shardLoad := map[*Shard]float64{}
+	for _, s := range table.sectors {
+		shardLoad[s.shard] += r.load.load(fromBound(s.bound)).total()
+	}
+	proposals := []splitProposal{}
+	for _, s := range table.sectors {
+		if min(s.bound.Max.X()-s.bound.Min.X(), s.bound.Max.Y()-s.bound.Min.Y()) < r.policy.MinSize*2 {
+			continue
+		}
+		bound := fromBound(s.bound)
+		p := splitProposal{Sector: bound, Shard: s.shard.LeaderAddr, Rate: r.load.load(bound).total()}
+		var reasons []string
+		if r.policy.MaxRate > 0 && p.Rate > r.policy.MaxRate {
+			reasons = append(reasons, fmt.Sprintf("%.3g requests/s over %.3g", p.Rate, r.policy.MaxRate))
+		}
+		if r.policy.MaxFeatures > 0 || r.policy.MaxBytes > 0 {
+			stats, err := r.sectorSize(ctx, s.shard, bound)
+			if err != nil {
+				slog.Error("sector stats", slog.String("shard", s.shard.LeaderAddr), slog.String("error", err.Error()))
+			} else {
+				p.Features, p.Bytes = stats.Features, stats.Bytes
+				if r.policy.MaxFeatures > 0 && p.Features > r.policy.MaxFeatures {
+					reasons = append(reasons, fmt.Sprintf("%d features over %d", p.Features, r.policy.MaxFeatures))
+				}
+				if r.policy.MaxBytes > 0 && p.Bytes > r.policy.MaxBytes {
+					reasons = append(reasons, fmt.Sprintf("%d bytes over %d", p.Bytes, r.policy.MaxBytes))
+				}
+			}
+		}
+		if len(reasons) == 0 {
+			continue
+		}
+		p.Reason = reasons[0]
+		for _, reason := range reasons[1:] {
+			p.Reason += ", " + reason
+		}
+		// the hotter half goes to the least loaded other shard, see hotHalf
+		p.To = s.shard.LeaderAddr
+		coolest := math.Inf(1)
+		for _, shard := range table.Shards() {
+			if shard != s.shard && shardLoad[shard] < coolest {
+				p.To, coolest = shard.LeaderAddr, shardLoad[shard]
+			}
+		}
+		proposals = append(proposals, p)
+	}
+	slices.SortStableFunc(proposals, func(a, b splitProposal) int { return cmp.Compare(b.Rate, a.Rate) })
+	return proposals
+}
+
+// applyPolicy evaluates the sectors, keeps the proposals and, if the policy
+// is Auto, splits the hottest sector unless a migration is in progress.
+// It returns the split made, if any.
+func (r *Router) applyPolicy(ctx context.Context) ([]splitProposal, *splitProposal, error) {
+	proposals := r.evaluate(ctx)
+	r.statsMu.Lock()
+	r.proposals = proposals
+	r.statsMu.Unlock()
+	if !r.policy.Auto || len(proposals) == 0 || !r.moveMu.TryLock() {
+		return proposals, nil, nil
+	}
+	defer r.moveMu.Unlock()
+	r.migMu.Lock()
+	pending := r.moving != nil && r.moving.Phase != phaseDone
+	r.migMu.Unlock()
+	if pending {
+		return proposals, nil, nil
+	}
+	p := proposals[0]
+	table := r.routes()
+	next, halves, err := table.Split(toBound(p.Sector))
+	if err != nil {
+		return proposals, nil, err
+	}
+	hot := r.hotHalf(ctx, table.shard(p.Shard), p.Sector, halves)
+	if p.To != p.Shard {
+		next, _ = next.Assign(hot, next.shard(p.To))
+	}
+	slog.Info("splitting hot sector", slog.String("sector", formatBound(p.Sector)), slog.String("reason", p.Reason), slog.String("to", p.To))
+	if _, err := r.shift(ctx, hot, p.Shard, p.To, next); err != nil {
+		return proposals, nil, err
+	}
+	return proposals, &p, nil
+}
+
+// hotHalf returns the half of a sector with the most requests, by the load
+// of the cells of its shard. The second half without any, or if the shard
+// can't tell.
+func (r *Router) hotHalf(ctx context.Context, shard *Shard, sector [4]float64, halves [2]orb.Bound) orb.Bound {
+	stats, err := r.sectorSize(ctx, shard, sector)
+	if err != nil {
+		slog.Error("sector stats", slog.String("shard", shard.LeaderAddr), slog.String("error", err.Error()))
+		return halves[1]
+	}
+	var load [2]float64
+	for _, cell := range stats.Cells {
+		center := toBound(cell.Bound).Center()
+		for i, half := range halves {
+			if half.Contains(center) {
+				load[i] += cell.total()
+				break
+			}
+		}
+	}
+	if load[0] > load[1] {
+		return halves[0]
+	}
+	return halves[1]
+}
+
+// enforce applies the split policy every interval until the Router stops.
+func (r *Router) enforce() {
+	if r.policy == nil || r.policy.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+		if _, _, err := r.applyPolicy(r.ctx); err != nil {
+			slog.Error("split policy", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// routerStats answers with the load of every sector and shard as the
+// Router sees it, and the splits the policy proposed last.
+func (r *Router) routerStats(w http.ResponseWriter, req *http.Request) {
+	table := r.routes()
+	type sectorLoad struct {
+		cellLoad
+		Shard string `json:"shard"`
+	}
+	sectors := []sectorLoad{}
+	shards := map[string]map[string]float64{}
+	for _, shard := range table.Shards() {
+		shards[shard.LeaderAddr] = map[string]float64{"reads": 0, "writes": 0, "bytes": 0}
+	}
+	for _, s := range table.sectors {
+		load := r.load.load(fromBound(s.bound))
+		sectors = append(sectors, sectorLoad{cellLoad: load, Shard: s.shard.LeaderAddr})
+		total := shards[s.shard.LeaderAddr]
+		total["reads"] += load.Reads
+		total["writes"] += load.Writes
+		total["bytes"] += load.Bytes
+	}
+	slices.SortStableFunc(sectors, func(a, b sectorLoad) int { return cmp.Compare(b.total(), a.total()) })
+	r.statsMu.Lock()
+	proposals := r.proposals
+	r.statsMu.Unlock()
+	writeJSON(w, map[string]any{
+		"halfLife":  loadHalfLife.String(),
+		"sectors":   sectors,
+		"shards":    shards,
+		"proposals": proposals,
+	})
+}
+
+// rebalanceEvaluate applies the split policy at once.
+func (r *Router) rebalanceEvaluate(w http.ResponseWriter, req *http.Request) {
+	if r.policy == nil {
+		http.Error(w, "no split policy", http.StatusNotFound)
+		return
+	}
+	proposals, split, err := r.applyPolicy(context.WithoutCancel(req.Context()))
+	if err != nil {
+		http.Error(w, "split failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, map[string]any{"proposals": proposals, "split": split})
+}
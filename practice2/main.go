@@ -6,14 +6,20 @@ import (
 	"errors"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	jsoniter "github.com/json-iterator/go"
+	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
 )
 
@@ -29,63 +35,116 @@ func init() {
 	geojson.CustomJSONUnmarshaler = c
 }
 
-type Router struct {
-	mux   *http.ServeMux
-	nodes [][]string
-}
-
-func NewRouter(mux *http.ServeMux, nodes [][]string) *Router {
-	// is it replica??? why are nodes are in form of table of strings
-	mux.Handle("/", http.FileServer(http.Dir("../front/dist")))
-	for _, row := range nodes {
-		for _, node := range row {
-			mux.Handle("/insert", http.RedirectHandler("/"+node+"/insert", http.StatusTemporaryRedirect))
-			mux.Handle("/replace", http.RedirectHandler("/"+node+"/replace", http.StatusTemporaryRedirect))
-			mux.Handle("/delete", http.RedirectHandler("/"+node+"/delete", http.StatusTemporaryRedirect))
-			mux.Handle("/select", http.RedirectHandler("/"+node+"/select", http.StatusTemporaryRedirect))
-			mux.Handle("/checkpoint", http.RedirectHandler("/"+node+"/checkpoint", http.StatusTemporaryRedirect))
-		}
-	}
-	return &Router{
-		mux:   mux,
-		nodes: nodes,
-	}
-}
-
-func (r *Router) Run() {
-	slog.Info("Router started")
-}
-
-func (r *Router) Stop() {
-	slog.Info("Router stopped")
-}
-
-func drain(m map[string]*geojson.Feature) *geojson.FeatureCollection {
+func drain(m map[string]*record) *geojson.FeatureCollection {
 	col := geojson.NewFeatureCollection()
-	for _, f := range m {
-		col.Append(f)
+	for _, rec := range m {
+		col.Append(rec.feature)
 	}
 	return col
 }
 
 type Storage struct {
-	name string
+	name     string
+	idPolicy IDPolicy
 
 	dbFile string
 	eng    *Engine
 
+	concern      WriteConcern
+	writeTimeout time.Duration
+
+	// reads in flight, over readThreshold they are redirected to replicas
+	inflight      atomic.Int64
+	readThreshold int64
+	balancer      balancer
+
+	// anti-entropy runs every repairInterval, with totals of what it fixed
+	repairInterval time.Duration
+	repairMu       sync.Mutex
+	repaired       repairStats
+	repairRuns     int
+
+	// the metadata Storage keeps the routing table, the others watch it,
+	// see metadata.go
+	metadata bool
+	metaMu   sync.Mutex
+	routing  *tableWatch
+
+	// decaying load of the cells of the map, see loadstats.go
+	load *loadHistogram
+
+	mu   sync.Mutex
 	jobs chan *Transaction
-	resp chan struct {
-		data []byte
-		err  error
-	}
+	resp chan response
 
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-func NewStorage(mux *http.ServeMux, name string, dbFile string) *Storage {
-	eng, err := NewEngine("engine.log", "engine.checkpoint")
+// StorageOption configures optional Storage behaviour.
+type StorageOption func(*Storage)
+
+// WithIDPolicy sets the policy for IDs of inserted features, IDGenerate by default.
+func WithIDPolicy(policy IDPolicy) StorageOption {
+	return func(s *Storage) {
+		s.idPolicy = policy
+	}
+}
+
+// WithHistoryRetention sets for how long replaced and deleted versions of
+// features are kept for history and asOf reads. By default history is kept
+// only until the next checkpoint.
+func WithHistoryRetention(retention time.Duration) StorageOption {
+	return func(s *Storage) {
+		s.eng.retention = retention
+	}
+}
+
+// WithTrashTTL sets for how long deleted features can be undeleted before
+// they are purged, 30 days by default. A ttl that isn't positive keeps the
+// default.
+func WithTrashTTL(ttl time.Duration) StorageOption {
+	return func(s *Storage) {
+		if ttl > 0 {
+			s.eng.trashTTL = ttl
+		}
+	}
+}
+
+// WithReplicas sets the addresses of the other Storages of the replica set,
+// such as http://127.0.0.1:8080/storage2. The Storage connects to their
+// /replication endpoints and applies the transactions they make.
+func WithReplicas(replicas ...string) StorageOption {
+	return func(s *Storage) {
+		s.eng.replicas = replicas
+	}
+}
+
+// WithLeader makes the Storage a follower of the replica set leader at
+// addr, such as http://127.0.0.1:8080/storage1. Followers only apply
+// replicated transactions and redirect writes to the leader.
+func WithLeader(addr string) StorageOption {
+	return func(s *Storage) {
+		s.eng.leader = false
+		s.eng.leaderAddr = addr
+	}
+}
+
+// WithElection makes the Storage elect the leader of the replica set
+// together with its replicas instead of having a fixed one. addr is the
+// address of the Storage itself, such as http://127.0.0.1:8080/storage1,
+// which followers redirect writes to when it is the leader.
+func WithElection(addr string) StorageOption {
+	return func(s *Storage) {
+		s.eng.addr = addr
+		s.eng.leader = false
+		s.eng.leaderAddr = ""
+	}
+}
+
+func NewStorage(mux *http.ServeMux, name string, dbFile string, opts ...StorageOption) *Storage {
+	base := strings.TrimSuffix(dbFile, ".json")
+	eng, err := NewEngine(name, base+".log", base+".checkpoint", base+".history", base+".term")
 	if err != nil {
 		panic(err.Error())
 	}
@@ -98,20 +157,49 @@ func NewStorage(mux *http.ServeMux, name string, dbFile string) *Storage {
 		eng:    eng,
 
 		jobs: make(chan *Transaction),
-		resp: make(chan struct {
-			data []byte
-			err  error
-		}),
+		resp: make(chan response),
+
+		balancer: balancer{replicas: make(map[string]*replicaStatus)},
+		load:     newLoadHistogram(),
 
 		ctx:    ctx,
 		cancel: cancel,
 	}
+	for _, opt := range opts {
+		opt(storage)
+	}
 
-	mux.HandleFunc("/"+name+"/insert", storage.insertHandler)
-	mux.HandleFunc("/"+name+"/replace", storage.replaceHandler)
-	mux.HandleFunc("/"+name+"/delete", storage.deleteHandler)
-	mux.HandleFunc("/"+name+"/select", storage.selectHandler)
+	mux.HandleFunc("/"+name+"/insert", storage.leaderOnly(storage.insertHandler))
+	mux.HandleFunc("/"+name+"/replace", storage.leaderOnly(storage.replaceHandler))
+	mux.HandleFunc("/"+name+"/delete", storage.leaderOnly(storage.deleteHandler))
+	mux.HandleFunc("/"+name+"/select", storage.balance(storage.consistent(storage.selectHandler)))
 	mux.HandleFunc("/"+name+"/checkpoint", storage.checkpointHandler)
+	mux.HandleFunc("GET /"+name+"/feature/{id}", storage.getHandler)
+	mux.HandleFunc("POST /"+name+"/features:get", storage.multiGetHandler)
+	mux.HandleFunc("PATCH /"+name+"/feature/{id}", storage.leaderOnly(storage.patchHandler))
+	mux.HandleFunc("GET /"+name+"/feature/{id}/history", storage.historyHandler)
+	mux.HandleFunc("GET /"+name+"/trash", storage.trashHandler)
+	mux.HandleFunc("POST /"+name+"/undelete", storage.leaderOnly(storage.undeleteHandler))
+	mux.HandleFunc("GET /"+name+"/replication", storage.replicationHandler)
+	mux.HandleFunc("GET /"+name+"/vclock", storage.vclockHandler)
+	mux.HandleFunc("GET /"+name+"/status", storage.statusHandler)
+	mux.HandleFunc("GET /"+name+"/health", storage.healthHandler)
+	mux.HandleFunc("GET /"+name+"/stats", storage.statsHandler)
+	mux.HandleFunc("GET /"+name+"/conflicts", storage.conflictsHandler)
+	mux.HandleFunc("GET /"+name+"/merkle", storage.merkleHandler)
+	mux.HandleFunc("GET /"+name+"/merkle/{bucket}", storage.bucketHandler)
+	mux.HandleFunc("POST /"+name+"/repair", storage.repairHandler)
+	mux.HandleFunc("POST /"+name+"/vote", storage.voteHandler)
+	mux.HandleFunc("POST /"+name+"/heartbeat", storage.heartbeatHandler)
+	mux.HandleFunc("GET /"+name+"/export", storage.exportHandler)
+	mux.HandleFunc("POST /"+name+"/hold/{id}", storage.leaderOnly(storage.holdHandler))
+	mux.HandleFunc("DELETE /"+name+"/hold/{id}", storage.leaderOnly(storage.releaseHandler))
+	mux.HandleFunc("POST /"+name+"/evict", storage.leaderOnly(storage.evictHandler))
+	mux.HandleFunc("POST /"+name+"/batch", storage.leaderOnly(storage.batchHandler))
+	if storage.metadata {
+		mux.HandleFunc("GET /"+name+"/routing", storage.routingHandler)
+		mux.HandleFunc("PUT /"+name+"/routing", storage.leaderOnly(storage.publishHandler))
+	}
 
 	return storage
 }
@@ -119,11 +207,22 @@ func NewStorage(mux *http.ServeMux, name string, dbFile string) *Storage {
 func (s *Storage) Run() {
 	s.loadFromFile()
 	s.eng.Run(s.jobs, s.resp)
+	if s.readThreshold > 0 && len(s.eng.replicas) > 0 {
+		go s.poll()
+	}
+	if s.repairInterval > 0 && len(s.eng.replicas) > 0 {
+		go s.antiEntropy()
+	}
+	if s.routing != nil {
+		go s.routing.watch(s.ctx)
+	}
 	slog.Info("Storage started", "name", s.name)
 }
 
 func (s *Storage) Stop() {
 	s.saveToFile()
+	s.cancel()
+	s.eng.Stop()
 	slog.Info("Storage stopped", "name", s.name)
 }
 
@@ -143,9 +242,11 @@ func (s *Storage) loadFromFile() {
 		if err != nil {
 			slog.Error("Failed to unmarshal DB", "err", err)
 		}
-		s.eng.primary = make(map[string]*geojson.Feature, len(col.Features))
 		for _, feature := range col.Features {
-			s.eng.primary[feature.ID.(string)] = feature
+			if _, exists := s.eng.primary[feature.ID.(string)]; exists {
+				continue
+			}
+			s.eng.applyTransaction(&Transaction{Action: "insert", Name: s.name, Feature: feature})
 		}
 	})
 }
@@ -169,91 +270,312 @@ func (s *Storage) saveToFile() {
 	}
 }
 
-func (s *Storage) insertHandler(w http.ResponseWriter, r *http.Request) {
-	slog.Info("insert method")
+// exec hands txn to the engine goroutine and waits for its response.
+func (s *Storage) exec(txn *Transaction) response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs <- txn
+	return <-s.resp
+}
+
+// writeError maps engine and validation errors to http status codes.
+func writeError(w http.ResponseWriter, err error) {
+	var ackErr *ackError
+	switch {
+	case errors.As(err, &ackErr):
+		w.Header().Set("X-Write-Acks", strconv.Itoa(ackErr.acks))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, errNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errHistoryGone):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, errPatchConflict), errors.Is(err, errTableVersion), errors.Is(err, errMoving):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errFenced):
+		http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+	case errors.Is(err, errNotLeader):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, errMissingID), errors.Is(err, errInvalidID), errors.Is(err, errNotUUID), errors.Is(err, errReserved),
+		errors.Is(err, errInvalidPatch), errors.Is(err, errInvalidConcern), errors.Is(err, errInvalidToken):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		slog.Error("storage error", slog.String("error", err.Error()))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// readFeature decodes a feature with a geometry from the request body.
+func readFeature(w http.ResponseWriter, r *http.Request) (*geojson.Feature, bool) {
 	buf, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
-		slog.Error("/insert read body", slog.Any("error", err.Error()))
+		slog.Error(r.URL.Path+" read body", slog.Any("error", err.Error()))
 	}
 	feature, err := geojson.UnmarshalFeature(buf)
-	if err != nil {
+	if err != nil || feature.Geometry == nil {
 		http.Error(w, "invalid geojson", http.StatusBadRequest)
+		return nil, false
+	}
+	return feature, true
+}
+
+func (s *Storage) insertHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("insert method")
+	feature, ok := readFeature(w, r)
+	if !ok {
+		return
+	}
+	id, err := s.assignID(feature)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !s.owns(w, r, id, feature) {
 		return
 	}
-	s.jobs <- &Transaction{
+	res := s.write(w, r, &Transaction{
 		Action:  "insert",
 		Name:    s.name,
 		LSN:     s.eng.lsn.Load(),
 		Feature: feature,
+	})
+	var ackErr *ackError
+	if errors.As(res.err, &ackErr) {
+		writeUnacked(w, ackErr, id)
+		return
 	}
-	_ = <-s.resp
-	w.WriteHeader(http.StatusOK)
+	if res.err != nil {
+		writeError(w, res.err)
+		return
+	}
+	s.recordFeature(loadWrite, feature, int(r.ContentLength))
+	writeJSON(w, map[string]string{"id": id})
 }
 
 func (s *Storage) replaceHandler(w http.ResponseWriter, r *http.Request) {
 	slog.Info("replace method")
-	buf, err := io.ReadAll(r.Body)
-	defer r.Body.Close()
-	if err != nil {
-		slog.Error("/replace read body", slog.Any("error", err.Error()))
+	feature, ok := readFeature(w, r)
+	if !ok {
+		return
 	}
-	feature, err := geojson.UnmarshalFeature(buf)
+	id, err := s.featureID(feature.ID)
 	if err != nil {
-		http.Error(w, "invalid geojson", http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
-	s.jobs <- &Transaction{
+	feature.ID = id
+	if !s.owns(w, r, id, feature) {
+		return
+	}
+	res := s.write(w, r, &Transaction{
 		Action:  "replace",
 		Name:    s.name,
 		LSN:     s.eng.lsn.Load(),
 		Feature: feature,
+	})
+	if res.err != nil {
+		writeError(w, res.err)
+		return
 	}
-	_ = <-s.resp
+	s.recordFeature(loadWrite, feature, int(r.ContentLength))
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *Storage) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	slog.Info("delete method")
 	var data struct {
-		ID string `json:"id"`
+		ID any `json:"id"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
+	id, err := s.featureID(data.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !s.ownsStored(w, r, id) {
+		return
+	}
 	feature := &geojson.Feature{}
-	feature.ID = data.ID
-	s.jobs <- &Transaction{
-		Action:  "replace",
+	feature.ID = id
+	res := s.write(w, r, &Transaction{
+		Action:  "delete",
 		Name:    s.name,
 		LSN:     s.eng.lsn.Load(),
 		Feature: feature,
+	})
+	if res.err != nil {
+		writeError(w, res.err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// trashHandler lists deleted features that can still be undeleted, with
+// their deletion times in the "deletedAt" member.
+func (s *Storage) trashHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("trash method")
+	features, deletedAt := s.eng.trashed()
+	col := geojson.NewFeatureCollection()
+	col.Features = append(col.Features, features...)
+	times := make(map[string]string, len(deletedAt))
+	for id, ts := range deletedAt {
+		times[id] = time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+	}
+	col.ExtraMembers = geojson.Properties{"deletedAt": times}
+	data, err := col.MarshalJSON()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (s *Storage) undeleteHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("undelete method")
+	var data struct {
+		ID any `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
 	}
-	res := <-s.resp
+	id, err := s.featureID(data.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	feature := &geojson.Feature{}
+	feature.ID = id
+	txn := &Transaction{
+		Action:  "undelete",
+		Name:    s.name,
+		LSN:     s.eng.lsn.Load(),
+		Feature: feature,
+	}
+	res := s.write(w, r, txn)
 	if res.err != nil {
-		http.Error(w, "can't delete", http.StatusBadRequest)
+		writeError(w, res.err)
+		return
 	}
+	w.Header().Set("ETag", etag(txn.Version))
 	w.WriteHeader(http.StatusOK)
 }
 
+// parseRect parses the "minx,miny,maxx,maxy" rect query parameter.
+func parseRect(get string) (orb.Bound, error) {
+	rect := strings.Split(get, ",")
+	if len(rect) < 4 {
+		return orb.Bound{}, errors.New("need 4 values for rect")
+	}
+	var v [4]float64
+	for i := range v {
+		f, err := strconv.ParseFloat(rect[i], 64)
+		if err != nil {
+			return orb.Bound{}, err
+		}
+		v[i] = f
+	}
+	return orb.Bound{Min: orb.Point{v[0], v[1]}, Max: orb.Point{v[2], v[3]}}, nil
+}
+
+// parseAsOf parses the asOf query parameter: either the seq of a
+// transaction in the history of the Storage or an RFC 3339 timestamp.
+func (s *Storage) parseAsOf(get string) (uint64, error) {
+	if seq, err := strconv.ParseUint(get, 10, 64); err == nil {
+		return seq, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, get)
+	if err != nil {
+		return 0, errors.New("asOf must be a seq or an RFC 3339 timestamp")
+	}
+	return s.eng.seqAt(t)
+}
+
+// selectAsOf answers a select from the retained history.
+func (s *Storage) selectAsOf(w http.ResponseWriter, get string, rect *orb.Bound) {
+	seq, err := s.parseAsOf(get)
+	if errors.Is(err, errHistoryGone) {
+		writeError(w, err)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	features, err := s.eng.snapshot(seq)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	col := geojson.NewFeatureCollection()
+	for _, feature := range features {
+		if rect == nil || rect.Intersects(feature.Geometry.Bound()) {
+			col.Append(feature)
+		}
+	}
+	slices.SortFunc(col.Features, func(a, b *geojson.Feature) int {
+		return strings.Compare(a.ID.(string), b.ID.(string))
+	})
+	data, err := col.MarshalJSON()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
 func (s *Storage) selectHandler(w http.ResponseWriter, r *http.Request) {
 	slog.Info("select method")
-	rect := r.URL.Query().Get("rect")
-	if len(rect) < 4 {
-		http.Error(w, "need 4 values for rect", http.StatusBadRequest)
+	// without rect the whole map is selected
+	var feature *geojson.Feature
+	var rect *orb.Bound
+	if get := r.URL.Query().Get("rect"); get != "" {
+		bound, err := parseRect(get)
+		if err != nil {
+			http.Error(w, "invalid rect: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		feature = geojson.NewFeature(bound)
+		rect = &bound
+		// only where there is something to read
+		s.eng.mu.Lock()
+		cells := s.eng.occupied(bound)
+		s.eng.mu.Unlock()
+		s.load.record(loadRead, 0, cells...)
+	}
+	if get := r.URL.Query().Get("asOf"); get != "" {
+		s.selectAsOf(w, get, rect)
 		return
 	}
 
-	s.jobs <- &Transaction{
+	res := s.exec(&Transaction{
 		Action:  "select",
 		Name:    s.name,
 		LSN:     s.eng.lsn.Load(),
-		Feature: nil,
-	}
-	res := <-s.resp
+		Feature: feature,
+	})
 	if res.err != nil {
 		http.Error(w, "can't select", http.StatusBadRequest)
+		return
 	}
 	slog.Debug(string(res.data))
 	w.Header().Set("Content-Type", "application/json")
@@ -261,17 +583,167 @@ func (s *Storage) selectHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(res.data)
 }
 
+func (s *Storage) historyHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("history method")
+	id, err := s.featureID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	history := s.eng.featureHistory(id)
+	if len(history) == 0 {
+		if found, _ := s.eng.get([]string{id}); len(found) == 0 {
+			writeError(w, errNotFound)
+			return
+		}
+	}
+	s.eng.mu.Lock()
+	horizon := s.eng.horizon
+	s.eng.mu.Unlock()
+	writeJSON(w, map[string]any{
+		"horizon": horizon,
+		"history": history,
+	})
+}
+
+// etag formats a feature version as a strong entity tag.
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+func (s *Storage) getHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("get method")
+	id, err := s.featureID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	found, _ := s.eng.get([]string{id})
+	if len(found) == 0 {
+		writeError(w, errNotFound)
+		return
+	}
+	if len(found[0].siblings) > 0 {
+		writeSiblings(w, &found[0])
+		return
+	}
+	data, err := found[0].feature.MarshalJSON()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.recordFeature(loadRead, found[0].feature, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(found[0].version))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// patchHandler applies a merge patch or a JSON Patch, chosen by the
+// Content-Type, and returns the patched feature.
+func (s *Storage) patchHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("patch method")
+	id, err := s.featureID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchType && mediaType != jsonPatchType {
+		http.Error(w, "unsupported patch type", http.StatusUnsupportedMediaType)
+		return
+	}
+	buf, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil || !json.Valid(buf) {
+		http.Error(w, "invalid patch", http.StatusBadRequest)
+		return
+	}
+	if !s.ownsStored(w, r, id) {
+		return
+	}
+	feature := &geojson.Feature{}
+	feature.ID = id
+	txn := &Transaction{
+		Action:  "patch",
+		Name:    s.name,
+		LSN:     s.eng.lsn.Load(),
+		Feature: feature,
+		Patch:   &Patch{Type: mediaType, Doc: buf},
+	}
+	res := s.write(w, r, txn)
+	if res.err != nil {
+		writeError(w, res.err)
+		return
+	}
+	data, err := txn.Feature.MarshalJSON()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(txn.Version))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// multiGetHandler returns the requested features as a feature collection
+// with their versions in the "versions" member and unknown IDs in "missing".
+// It answers 404 only when none of the IDs are stored.
+func (s *Storage) multiGetHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("multi get method")
+	var data struct {
+		IDs []any `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || len(data.IDs) == 0 {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	ids := make([]string, 0, len(data.IDs))
+	for _, raw := range data.IDs {
+		id, err := s.featureID(raw)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	found, missing := s.eng.get(ids)
+	if len(found) == 0 {
+		writeError(w, errNotFound)
+		return
+	}
+	col := geojson.NewFeatureCollection()
+	versions := make(map[string]uint64, len(found))
+	for _, rec := range found {
+		col.Append(rec.feature)
+		versions[rec.feature.ID.(string)] = rec.version
+	}
+	col.ExtraMembers = geojson.Properties{"versions": versions}
+	if len(missing) > 0 {
+		col.ExtraMembers["missing"] = missing
+	}
+	buf, err := col.MarshalJSON()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
+
 func (s *Storage) checkpointHandler(w http.ResponseWriter, r *http.Request) {
 	slog.Info("checkpoint method")
-	s.jobs <- &Transaction{
-		Action:  "replace",
+	res := s.exec(&Transaction{
+		Action:  "checkpoint",
 		Name:    s.name,
 		LSN:     s.eng.lsn.Load(),
 		Feature: nil,
-	}
-	res := <-s.resp
+	})
 	if res.err != nil {
 		http.Error(w, "can't checkpoint", http.StatusBadRequest)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
@@ -280,7 +752,17 @@ func main() {
 	mux := http.NewServeMux()
 
 	storage := NewStorage(mux, "storage", "geo.db.json")
-	router := NewRouter(mux, [][]string{{"storage"}})
+	// the routing table is laid out once and kept with its strategy
+	table, err := LoadRoutingTable("routing.json")
+	if errors.Is(err, os.ErrNotExist) {
+		table = NewGridTable([][]string{{"storage"}})
+		err = table.Save("routing.json")
+	}
+	if err != nil {
+		slog.Error("routing table", "err", err)
+		os.Exit(1)
+	}
+	router := NewRouter(mux, table, WithTablePath("routing.json"))
 
 	storage.Run()
 	router.Run()
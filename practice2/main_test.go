@@ -3,13 +3,24 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"log/slog"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
 	"github.com/stretchr/testify/require"
@@ -20,16 +31,69 @@ func encodePoint(point *geojson.Feature) []byte {
 	return data
 }
 
+// removeDB removes the db file of a storage together with its engine log and checkpoint.
+func removeDB(t *testing.T, base string) {
+	for _, ext := range []string{".json", ".log", ".checkpoint", ".history", ".term"} {
+		if err := os.Remove(base + ext); err != nil && !os.IsNotExist(err) {
+			t.Fatal("remove error")
+		}
+	}
+}
+
+// startCluster runs a Storage with opts for every shard name on mux, and a
+// Router with routerOpts over them on the same mux: by the table, or by a
+// grid of a column per name if nil. They are stopped, and the files of the
+// Storages removed, when the test ends.
+func startCluster(t *testing.T, mux *http.ServeMux, names []string, opts []StorageOption, table *RoutingTable, routerOpts ...RouterOption) ([]*Storage, *Router) {
+	var storages []*Storage
+	for _, name := range names {
+		removeDB(t, name+"_geo.db")
+		s := NewStorage(mux, name, name+"_geo.db.json", opts...)
+		s.Run()
+		storages = append(storages, s)
+	}
+	if table == nil {
+		var columns [][]string
+		for _, name := range names {
+			columns = append(columns, []string{name})
+		}
+		table = NewGridTable(columns)
+	}
+	router := NewRouter(mux, table, routerOpts...)
+	router.Run()
+	t.Cleanup(func() {
+		router.Stop()
+		for _, s := range storages {
+			s.Stop()
+			removeDB(t, s.name+"_geo.db")
+		}
+	})
+	return storages, router
+}
+
+// serve sends a request to mux and follows a single temporary redirect.
+func serve(t *testing.T, mux *http.ServeMux, method, url string, body []byte) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code == http.StatusTemporaryRedirect {
+		req, err = http.NewRequest(method, rec.Header().Get("Location"), bytes.NewReader(body))
+		require.NoError(t, err)
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+	}
+	return rec
+}
+
 func TestAPI(t *testing.T) {
 	slog.SetLogLoggerLevel(slog.LevelDebug)
 	mux := http.NewServeMux()
 
-	if err := os.Remove("test_geo.db.json"); err != nil && !os.IsNotExist(err) {
-		t.Fatal("remove error")
-	}
+	removeDB(t, "test_geo.db")
 
 	storage := NewStorage(mux, "test", "test_geo.db.json")
-	router := NewRouter(mux, [][]string{{"test"}})
+	router := NewRouter(mux, NewGridTable([][]string{{"test"}}))
 	storage.Run()
 	router.Run()
 	t.Cleanup(func() {
@@ -153,7 +217,7 @@ func TestAPI(t *testing.T) {
 
 			if rec.Code == http.StatusTemporaryRedirect {
 				location := rec.Header().Get("Location")
-				req, err = http.NewRequest(test.method, location, body)
+				req, err = http.NewRequest(test.method, location, bytes.NewReader(test.body))
 				require.NoError(t, err)
 				rec = httptest.NewRecorder()
 				mux.ServeHTTP(rec, req)
@@ -164,8 +228,2174 @@ func TestAPI(t *testing.T) {
 			if test.name == "Select all features" && rec.Code == http.StatusOK {
 				// var collection geojson.FeatureCollection
 				// require.NoError(t, json.NewDecoder(rec.Body).Decode(&collection))
-				require.Equal(t, string(test.response), string(rec.Body.Bytes()))
+				// members of a collection come in map order
+				require.JSONEq(t, string(test.response), string(rec.Body.Bytes()))
+			}
+		})
+	}
+}
+
+func TestInsertID(t *testing.T) {
+	point := `{"type":"Feature","geometry":{"type":"Point","coordinates":[1,2]},"properties":{}`
+
+	tests := []struct {
+		name       string
+		policy     IDPolicy
+		body       string
+		statusCode int
+		id         string
+	}{
+		{name: "Generate missing", policy: IDGenerate, body: point + `}`, statusCode: http.StatusOK},
+		{name: "Keep string", policy: IDGenerate, body: point + `,"id":"pin"}`, statusCode: http.StatusOK, id: "pin"},
+		{name: "Normalize number", policy: IDGenerate, body: point + `,"id":42}`, statusCode: http.StatusOK, id: "42"},
+		{name: "Reject fraction", policy: IDGenerate, body: point + `,"id":4.2}`, statusCode: http.StatusBadRequest},
+		{name: "Reject object", policy: IDGenerate, body: point + `,"id":{"a":1}}`, statusCode: http.StatusBadRequest},
+		{name: "Require missing", policy: IDRequire, body: point + `}`, statusCode: http.StatusBadRequest},
+		{name: "Require number", policy: IDRequire, body: point + `,"id":7}`, statusCode: http.StatusOK, id: "7"},
+		{name: "UUID missing", policy: IDUUID, body: point + `}`, statusCode: http.StatusOK},
+		{name: "UUID invalid", policy: IDUUID, body: point + `,"id":"pin"}`, statusCode: http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := "id" + strconv.Itoa(i)
+			removeDB(t, name+"_geo.db")
+			mux := http.NewServeMux()
+			storage := NewStorage(mux, name, name+"_geo.db.json", WithIDPolicy(test.policy))
+			storage.Run()
+			t.Cleanup(func() {
+				storage.Stop()
+				removeDB(t, name+"_geo.db")
+			})
+
+			req, err := http.NewRequest("POST", "/"+name+"/insert", strings.NewReader(test.body))
+			require.NoError(t, err)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			require.Equal(t, test.statusCode, rec.Code, rec.Body.String())
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				ID string `json:"id"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			if test.id != "" {
+				require.Equal(t, test.id, resp.ID)
+				return
+			}
+			id, err := uuid.Parse(resp.ID)
+			require.NoError(t, err)
+			require.Equal(t, uuid.Version(7), id.Version())
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	removeDB(t, "get_geo.db")
+	mux := http.NewServeMux()
+	storage := NewStorage(mux, "get", "get_geo.db.json")
+	router := NewRouter(mux, NewGridTable([][]string{{"get"}}))
+	storage.Run()
+	router.Run()
+	t.Cleanup(func() {
+		storage.Stop()
+		router.Stop()
+		removeDB(t, "get_geo.db")
+	})
+
+	point := geojson.NewFeature(orb.Point{1, 2})
+	point.ID = "pin"
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/insert", encodePoint(point)).Code)
+	point.Properties["note"] = "moved"
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/replace", encodePoint(point)).Code)
+
+	rec := serve(t, mux, "GET", "/feature/pin", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, `"2"`, rec.Header().Get("ETag"))
+	require.Equal(t, string(encodePoint(point)), rec.Body.String())
+
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "GET", "/feature/nope", nil).Code)
+
+	rec = serve(t, mux, "POST", "/features:get", []byte(`{"ids":["pin","nope"]}`))
+	require.Equal(t, http.StatusOK, rec.Code)
+	col, err := geojson.UnmarshalFeatureCollection(rec.Body.Bytes())
+	require.NoError(t, err)
+	require.Len(t, col.Features, 1)
+	require.Equal(t, map[string]any{"pin": float64(2)}, col.ExtraMembers["versions"])
+	require.Equal(t, []any{"nope"}, col.ExtraMembers["missing"])
+
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "POST", "/features:get", []byte(`{"ids":["nope"]}`)).Code)
+}
+
+func TestPatch(t *testing.T) {
+	removeDB(t, "patch_geo.db")
+	mux := http.NewServeMux()
+	storage := NewStorage(mux, "patch", "patch_geo.db.json")
+	storage.Run()
+	t.Cleanup(func() {
+		storage.Stop()
+		removeDB(t, "patch_geo.db")
+	})
+
+	point := geojson.NewFeature(orb.Point{1, 2})
+	point.ID = "pin"
+	point.Properties["note"] = "first"
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/patch/insert", encodePoint(point)).Code)
+
+	tests := []struct {
+		name        string
+		contentType string
+		id          string
+		body        string
+		statusCode  int
+		etag        string
+		rect        string
+	}{
+		{name: "Merge patch", contentType: mergePatchType, id: "pin", body: `{"properties":{"note":"second","photo":"a.jpg"}}`, statusCode: http.StatusOK, etag: `"2"`, rect: "0,1,2,3"},
+		{name: "JSON patch geometry", contentType: jsonPatchType, id: "pin", body: `[{"op":"replace","path":"/geometry/coordinates","value":[10,20]}]`, statusCode: http.StatusOK, etag: `"3"`, rect: "9,19,11,21"},
+		{name: "Failed test", contentType: jsonPatchType, id: "pin", body: `[{"op":"test","path":"/properties/note","value":"first"}]`, statusCode: http.StatusConflict},
+		{name: "Change id", contentType: mergePatchType, id: "pin", body: `{"id":"other"}`, statusCode: http.StatusBadRequest},
+		{name: "Drop geometry", contentType: mergePatchType, id: "pin", body: `{"geometry":null}`, statusCode: http.StatusBadRequest},
+		{name: "Unsupported type", contentType: "application/json", id: "pin", body: `{}`, statusCode: http.StatusUnsupportedMediaType},
+		{name: "Missing feature", contentType: mergePatchType, id: "nope", body: `{}`, statusCode: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("PATCH", "/patch/feature/"+test.id, strings.NewReader(test.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", test.contentType)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			require.Equal(t, test.statusCode, rec.Code, rec.Body.String())
+			if rec.Code != http.StatusOK {
+				return
 			}
+			require.Equal(t, test.etag, rec.Header().Get("ETag"))
+
+			rec = serve(t, mux, "GET", "/patch/select?rect="+test.rect, nil)
+			require.Equal(t, http.StatusOK, rec.Code)
+			col, err := geojson.UnmarshalFeatureCollection(rec.Body.Bytes())
+			require.NoError(t, err)
+			require.Len(t, col.Features, 1)
+			require.Equal(t, "second", col.Features[0].Properties["note"])
 		})
 	}
+
+	rec := serve(t, mux, "GET", "/patch/select?rect=0,1,2,3", nil)
+	col, err := geojson.UnmarshalFeatureCollection(rec.Body.Bytes())
+	require.NoError(t, err)
+	require.Empty(t, col.Features)
+}
+
+func TestHistory(t *testing.T) {
+	removeDB(t, "history_geo.db")
+	t.Cleanup(func() { removeDB(t, "history_geo.db") })
+	start := func(retention time.Duration) (*http.ServeMux, *Storage) {
+		mux := http.NewServeMux()
+		storage := NewStorage(mux, "history", "history_geo.db.json", WithHistoryRetention(retention))
+		storage.Run()
+		return mux, storage
+	}
+	notes := func(t *testing.T, mux *http.ServeMux, url string) []any {
+		rec := serve(t, mux, "GET", url, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		col, err := geojson.UnmarshalFeatureCollection(rec.Body.Bytes())
+		require.NoError(t, err)
+		var notes []any
+		for _, f := range col.Features {
+			notes = append(notes, f.Properties["note"])
+		}
+		return notes
+	}
+
+	mux, storage := start(time.Hour)
+	point := geojson.NewFeature(orb.Point{1, 2})
+	point.ID = "pin"
+	point.Properties["note"] = "first"
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/history/insert", encodePoint(point)).Code)
+	between := time.Now()
+	point.Properties["note"] = "second"
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/history/replace", encodePoint(point)).Code)
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/history/delete", []byte(`{"id":"pin"}`)).Code)
+
+	require.Empty(t, notes(t, mux, "/history/select"))
+	require.Equal(t, []any{"first"}, notes(t, mux, "/history/select?asOf=1"))
+	require.Equal(t, []any{"second"}, notes(t, mux, "/history/select?asOf=2&rect=0,0,3,3"))
+	require.Empty(t, notes(t, mux, "/history/select?asOf=2&rect=5,5,6,6"))
+	require.Equal(t, []any{"first"}, notes(t, mux, "/history/select?asOf="+between.Format(time.RFC3339Nano)))
+	require.Equal(t, http.StatusBadRequest, serve(t, mux, "GET", "/history/select?asOf=yesterday", nil).Code)
+
+	// history is retained over checkpoints and restarts
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/history/checkpoint", nil).Code)
+	storage.Stop()
+	mux, storage = start(0)
+
+	rec := serve(t, mux, "GET", "/history/feature/pin/history", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Horizon uint64        `json:"horizon"`
+		History []Transaction `json:"history"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.History, 3)
+	require.Equal(t, "replace", resp.History[1].Action)
+	require.Equal(t, uint64(2), resp.History[1].Version)
+	require.Equal(t, []any{"first"}, notes(t, mux, "/history/select?asOf=1"))
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "GET", "/history/feature/nope/history", nil).Code)
+
+	// without retention a checkpoint drops the history
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/history/checkpoint", nil).Code)
+	require.Equal(t, http.StatusGone, serve(t, mux, "GET", "/history/select?asOf=1", nil).Code)
+	require.Equal(t, http.StatusGone, serve(t, mux, "GET", "/history/select?asOf="+between.Format(time.RFC3339Nano), nil).Code)
+	require.Empty(t, notes(t, mux, "/history/select?asOf=3"))
+
+	point.ID = "next"
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/history/insert", encodePoint(point)).Code)
+	require.Empty(t, notes(t, mux, "/history/select?asOf=3"))
+	require.Equal(t, []any{"second"}, notes(t, mux, "/history/select?asOf=4"))
+	storage.Stop()
+}
+
+func TestHistoryLeaderChange(t *testing.T) {
+	removeDB(t, "asof_geo.db")
+	mux := http.NewServeMux()
+	storage := NewStorage(mux, "asof", "asof_geo.db.json", WithHistoryRetention(time.Hour))
+	storage.Run()
+	t.Cleanup(func() {
+		storage.Stop()
+		removeDB(t, "asof_geo.db")
+	})
+	notes := func(url string) []any {
+		rec := serve(t, mux, "GET", url, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		col, err := geojson.UnmarshalFeatureCollection(rec.Body.Bytes())
+		require.NoError(t, err)
+		var notes []any
+		for _, f := range col.Features {
+			notes = append(notes, f.Properties["note"])
+		}
+		return notes
+	}
+
+	// three local writes, LSNs 1 to 3
+	for i, note := range []string{"a", "b", "c"} {
+		point := geojson.NewFeature(orb.Point{1, float64(i)})
+		point.ID = "p" + strconv.Itoa(i)
+		point.Properties["note"] = note
+		require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/asof/insert", encodePoint(point)).Code)
+	}
+	failover := time.Now()
+
+	// then the new leader replaces p0 and p1 with its own LSNs 1 and 2
+	for i := range 2 {
+		point := geojson.NewFeature(orb.Point{1, float64(i)})
+		point.ID = "p" + strconv.Itoa(i)
+		point.Properties["note"] = "new"
+		require.NoError(t, storage.eng.replicate(&Transaction{
+			Action:  "replace",
+			Name:    "leader2",
+			LSN:     uint64(i + 1),
+			Version: 2,
+			Term:    1,
+			Clock:   map[string]uint64{"asof": uint64(i + 1), "leader2": uint64(i + 1)},
+			HLC:     storage.eng.now(),
+			Time:    time.Now().UnixNano(),
+			Feature: point,
+		}))
+	}
+
+	require.Equal(t, []any{"new", "new", "c"}, notes("/asof/select"))
+	require.Equal(t, []any{"a", "b"}, notes("/asof/select?asOf=2"))
+	require.Equal(t, []any{"a", "b", "c"}, notes("/asof/select?asOf=3"))
+	require.Equal(t, []any{"new", "b", "c"}, notes("/asof/select?asOf=4"))
+	require.Equal(t, []any{"a", "b", "c"}, notes("/asof/select?asOf="+failover.Format(time.RFC3339Nano)))
+
+	// the replicated records are ordered where they were applied
+	rec := serve(t, mux, "GET", "/asof/feature/p1/history", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		History []Transaction `json:"history"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.History, 2)
+	require.Equal(t, uint64(2), resp.History[0].Seq)
+	require.Equal(t, uint64(5), resp.History[1].Seq)
+	require.Equal(t, uint64(2), resp.History[1].LSN)
+}
+
+func TestTrash(t *testing.T) {
+	removeDB(t, "trash_geo.db")
+	t.Cleanup(func() { removeDB(t, "trash_geo.db") })
+	start := func(opts ...StorageOption) (*http.ServeMux, *Storage) {
+		mux := http.NewServeMux()
+		storage := NewStorage(mux, "trash", "trash_geo.db.json", opts...)
+		storage.Run()
+		return mux, storage
+	}
+	ids := func(t *testing.T, mux *http.ServeMux, url string) []any {
+		rec := serve(t, mux, "GET", url, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		col, err := geojson.UnmarshalFeatureCollection(rec.Body.Bytes())
+		require.NoError(t, err)
+		ids := []any{}
+		for _, f := range col.Features {
+			ids = append(ids, f.ID)
+		}
+		return ids
+	}
+
+	mux, storage := start()
+	for _, id := range []string{"a", "b"} {
+		point := geojson.NewFeature(orb.Point{1, 2})
+		point.ID = id
+		require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/trash/insert", encodePoint(point)).Code)
+	}
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/trash/delete", []byte(`{"id":"a"}`)).Code)
+	require.Equal(t, []any{"b"}, ids(t, mux, "/trash/select"))
+	require.Equal(t, []any{"a"}, ids(t, mux, "/trash/trash"))
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "GET", "/trash/feature/a", nil).Code)
+
+	rec := serve(t, mux, "POST", "/trash/undelete", []byte(`{"id":"a"}`))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, `"2"`, rec.Header().Get("ETag"))
+	require.Equal(t, []any{"a", "b"}, ids(t, mux, "/trash/select"))
+	require.Equal(t, []any{}, ids(t, mux, "/trash/trash"))
+	require.Equal(t, http.StatusConflict, serve(t, mux, "POST", "/trash/undelete", []byte(`{"id":"a"}`)).Code)
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "POST", "/trash/undelete", []byte(`{"id":"nope"}`)).Code)
+
+	// tombstones survive checkpoints and restarts
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/trash/delete", []byte(`{"id":"b"}`)).Code)
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/trash/checkpoint", nil).Code)
+	storage.Stop()
+	mux, storage = start()
+	require.Equal(t, []any{"a"}, ids(t, mux, "/trash/select"))
+	require.Equal(t, []any{"b"}, ids(t, mux, "/trash/trash"))
+	storage.Stop()
+
+	// a ttl that isn't positive keeps the default
+	mux, storage = start(WithTrashTTL(0))
+	require.Equal(t, defaultTrashTTL, storage.eng.trashTTL)
+	require.Equal(t, []any{"b"}, ids(t, mux, "/trash/trash"))
+	storage.Stop()
+
+	// expired tombstones are purged by the sweeper
+	mux, storage = start(WithTrashTTL(10 * time.Millisecond))
+	t.Cleanup(storage.Stop)
+	require.Eventually(t, func() bool {
+		return len(ids(t, mux, "/trash/trash")) == 0
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "POST", "/trash/undelete", []byte(`{"id":"b"}`)).Code)
+	require.Equal(t, []any{"a"}, ids(t, mux, "/trash/select"))
+}
+
+// swapMux serves requests with the mux it currently holds, so that a
+// Storage can be restarted behind the same address.
+type swapMux struct {
+	atomic.Pointer[http.ServeMux]
+}
+
+func (m *swapMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Load().ServeHTTP(w, r)
+}
+
+func TestReplication(t *testing.T) {
+	for _, name := range []string{"repa", "repb"} {
+		removeDB(t, name+"_geo.db")
+	}
+	muxA, muxB := &swapMux{}, &swapMux{}
+	muxA.Store(http.NewServeMux())
+	muxB.Store(http.NewServeMux())
+	srvA, srvB := httptest.NewServer(muxA), httptest.NewServer(muxB)
+	start := func(mux *swapMux, name, replica string) *Storage {
+		mux.Store(http.NewServeMux())
+		storage := NewStorage(mux.Load(), name, name+"_geo.db.json", WithReplicas(replica))
+		storage.Run()
+		return storage
+	}
+	a := start(muxA, "repa", srvB.URL+"/repb")
+	b := start(muxB, "repb", srvA.URL+"/repa")
+	t.Cleanup(func() {
+		a.Stop()
+		b.Stop()
+		srvA.Close()
+		srvB.Close()
+		for _, name := range []string{"repa", "repb"} {
+			removeDB(t, name+"_geo.db")
+		}
+	})
+	connected := func(s *Storage, peer string) func() bool {
+		return func() bool {
+			s.eng.peersMu.Lock()
+			defer s.eng.peersMu.Unlock()
+			_, ok := s.eng.peers[peer]
+			return ok
+		}
+	}
+	require.Eventually(t, connected(a, "repb"), time.Second, 10*time.Millisecond)
+	require.Eventually(t, connected(b, "repa"), time.Second, 10*time.Millisecond)
+
+	version := func(mux *swapMux, url string) func() string {
+		return func() string {
+			return serve(t, mux.Load(), "GET", url, nil).Header().Get("ETag")
+		}
+	}
+
+	point := geojson.NewFeature(orb.Point{1, 2})
+	point.ID = "from-a"
+	require.Equal(t, http.StatusOK, serve(t, muxA.Load(), "POST", "/repa/insert", encodePoint(point)).Code)
+	point.ID = "from-b"
+	require.Equal(t, http.StatusOK, serve(t, muxB.Load(), "POST", "/repb/insert", encodePoint(point)).Code)
+	require.Eventually(t, func() bool { return version(muxB, "/repb/feature/from-a")() == `"1"` }, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool { return version(muxA, "/repa/feature/from-b")() == `"1"` }, time.Second, 10*time.Millisecond)
+
+	req, err := http.NewRequest("PATCH", "/repa/feature/from-b", strings.NewReader(`{"properties":{"note":"a"}}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", mergePatchType)
+	rec := httptest.NewRecorder()
+	muxA.Load().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Eventually(t, func() bool { return version(muxB, "/repb/feature/from-b")() == `"2"` }, time.Second, 10*time.Millisecond)
+
+	// a restarted replica is connected again
+	b.Stop()
+	require.Eventually(t, func() bool { return !connected(a, "repb")() }, time.Second, 10*time.Millisecond)
+	b = start(muxB, "repb", srvA.URL+"/repa")
+	require.Eventually(t, connected(a, "repb"), 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, `"2"`, version(muxB, "/repb/feature/from-b")())
+
+	require.Equal(t, http.StatusOK, serve(t, muxA.Load(), "POST", "/repa/delete", []byte(`{"id":"from-a"}`)).Code)
+	require.Eventually(t, func() bool {
+		return serve(t, muxB.Load(), "GET", "/repb/feature/from-a", nil).Code == http.StatusNotFound
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestVClock(t *testing.T) {
+	removeDB(t, "vclock_geo.db")
+	t.Cleanup(func() { removeDB(t, "vclock_geo.db") })
+	start := func() (*http.ServeMux, *Storage) {
+		mux := http.NewServeMux()
+		storage := NewStorage(mux, "vclock", "vclock_geo.db.json")
+		storage.Run()
+		return mux, storage
+	}
+	vclock := func(t *testing.T, mux *http.ServeMux) map[string]uint64 {
+		rec := serve(t, mux, "GET", "/vclock/vclock", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var vclock map[string]uint64
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &vclock))
+		return vclock
+	}
+	remote := func(id string, lsn uint64) *Transaction {
+		feature := geojson.NewFeature(orb.Point{1, 2})
+		feature.ID = id
+		return &Transaction{Action: "insert", Name: "other", LSN: lsn, Feature: feature}
+	}
+
+	mux, storage := start()
+	point := geojson.NewFeature(orb.Point{1, 2})
+	point.ID = "local"
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/vclock/insert", encodePoint(point)).Code)
+	require.NoError(t, storage.eng.replicate(remote("first", 1)))
+	require.NoError(t, storage.eng.replicate(remote("dup", 1)))
+	require.NoError(t, storage.eng.replicate(remote("third", 3)))
+	require.NoError(t, storage.eng.replicate(remote("late", 2)))
+	require.Equal(t, map[string]uint64{"vclock": 1, "other": 3}, vclock(t, mux))
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "GET", "/vclock/feature/dup", nil).Code)
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "GET", "/vclock/feature/late", nil).Code)
+
+	// the clock is restored from the checkpoint and the log
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/vclock/checkpoint", nil).Code)
+	require.NoError(t, storage.eng.replicate(remote("fourth", 4)))
+	storage.Stop()
+	mux, storage = start()
+	t.Cleanup(storage.Stop)
+	require.Equal(t, map[string]uint64{"vclock": 1, "other": 4}, vclock(t, mux))
+	require.NoError(t, storage.eng.replicate(remote("again", 4)))
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "GET", "/vclock/feature/again", nil).Code)
+
+	point.ID = "next"
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/vclock/insert", encodePoint(point)).Code)
+	require.Equal(t, map[string]uint64{"vclock": 2, "other": 4}, vclock(t, mux))
+}
+
+func TestCatchUp(t *testing.T) {
+	for _, name := range []string{"catcha", "catchb"} {
+		removeDB(t, name+"_geo.db")
+	}
+	muxA, muxB := &swapMux{}, &swapMux{}
+	muxA.Store(http.NewServeMux())
+	muxB.Store(http.NewServeMux())
+	srvA, srvB := httptest.NewServer(muxA), httptest.NewServer(muxB)
+	a := NewStorage(muxA.Load(), "catcha", "catcha_geo.db.json", WithHistoryRetention(0))
+	a.Run()
+	var b *Storage
+	startB := func() {
+		muxB.Store(http.NewServeMux())
+		b = NewStorage(muxB.Load(), "catchb", "catchb_geo.db.json", WithReplicas(srvA.URL+"/catcha"))
+		b.Run()
+	}
+	connected := func() bool {
+		a.eng.peersMu.Lock()
+		defer a.eng.peersMu.Unlock()
+		_, ok := a.eng.peers["catchb"]
+		return ok
+	}
+	startB()
+	t.Cleanup(func() {
+		a.Stop()
+		b.Stop()
+		srvA.Close()
+		srvB.Close()
+		for _, name := range []string{"catcha", "catchb"} {
+			removeDB(t, name+"_geo.db")
+		}
+	})
+	require.Eventually(t, connected, time.Second, 10*time.Millisecond)
+
+	insert := func(id string) {
+		point := geojson.NewFeature(orb.Point{1, 2})
+		point.ID = id
+		require.Equal(t, http.StatusOK, serve(t, muxA.Load(), "POST", "/catcha/insert", encodePoint(point)).Code)
+	}
+	found := func(url string) func() bool {
+		return func() bool {
+			return serve(t, muxB.Load(), "GET", url, nil).Code == http.StatusOK
+		}
+	}
+	stopB := func() {
+		b.Stop()
+		require.Eventually(t, func() bool { return !connected() }, time.Second, 10*time.Millisecond)
+	}
+	insert("live")
+	require.Eventually(t, found("/catchb/feature/live"), time.Second, 10*time.Millisecond)
+
+	// the transactions missed while down are shipped from the log
+	stopB()
+	insert("missed")
+	startB()
+	require.Eventually(t, found("/catchb/feature/missed"), 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, a.eng.clock()["catcha"], b.eng.clock()["catcha"])
+
+	// once the log is truncated a snapshot is shipped, followed by the tail
+	stopB()
+	insert("deleted")
+	require.Equal(t, http.StatusOK, serve(t, muxA.Load(), "POST", "/catcha/delete", []byte(`{"id":"deleted"}`)).Code)
+	require.Equal(t, http.StatusOK, serve(t, muxA.Load(), "POST", "/catcha/checkpoint", nil).Code)
+	lsn := b.eng.clock()["catcha"]
+	a.eng.mu.Lock()
+	_, ok := a.eng.backlog(lsn)
+	a.eng.mu.Unlock()
+	require.False(t, ok)
+	insert("tail")
+	startB()
+	require.Eventually(t, found("/catchb/feature/tail"), 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return a.eng.clock()["catcha"] == b.eng.clock()["catcha"]
+	}, time.Second, 10*time.Millisecond)
+	rec := serve(t, muxB.Load(), "GET", "/catchb/trash", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"deleted"`)
+	require.True(t, found("/catchb/feature/live")())
+	require.True(t, found("/catchb/feature/missed")())
+
+	// the installed snapshot survives a restart
+	stopB()
+	startB()
+	require.True(t, found("/catchb/feature/tail")())
+	require.Equal(t, a.eng.clock()["catcha"], b.eng.clock()["catcha"])
+}
+
+func TestLeader(t *testing.T) {
+	for _, name := range []string{"leada", "leadb"} {
+		removeDB(t, name+"_geo.db")
+	}
+	muxA, muxB := http.NewServeMux(), http.NewServeMux()
+	srvA, srvB := httptest.NewServer(muxA), httptest.NewServer(muxB)
+	a := NewStorage(muxA, "leada", "leada_geo.db.json")
+	b := NewStorage(muxB, "leadb", "leadb_geo.db.json", WithLeader(srvA.URL+"/leada"), WithReplicas(srvA.URL+"/leada"))
+	a.Run()
+	b.Run()
+	t.Cleanup(func() {
+		a.Stop()
+		b.Stop()
+		srvA.Close()
+		srvB.Close()
+		for _, name := range []string{"leada", "leadb"} {
+			removeDB(t, name+"_geo.db")
+		}
+	})
+
+	status := func(mux *http.ServeMux, url string) map[string]any {
+		rec := serve(t, mux, "GET", url, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var status map[string]any
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		return status
+	}
+	require.Equal(t, "leader", status(muxA, "/leada/status")["role"])
+	require.Equal(t, "follower", status(muxB, "/leadb/status")["role"])
+	require.Equal(t, srvA.URL+"/leada", status(muxB, "/leadb/status")["leader"])
+
+	// a write sent to the follower is redirected to the leader and replicated back
+	point := geojson.NewFeature(orb.Point{1, 2})
+	point.ID = "forwarded"
+	req, err := http.NewRequest("POST", "/leadb/insert", bytes.NewReader(encodePoint(point)))
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	muxB.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	require.Equal(t, srvA.URL+"/leada/insert", rec.Header().Get("Location"))
+	resp, err := http.Post(srvB.URL+"/leadb/insert", "application/geo+json", bytes.NewReader(encodePoint(point)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, http.StatusOK, serve(t, muxA, "GET", "/leada/feature/forwarded", nil).Code)
+	require.Eventually(t, func() bool {
+		return serve(t, muxB, "GET", "/leadb/feature/forwarded", nil).Code == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	// followers never create transactions themselves
+	point.ID = "local"
+	err = b.eng.saveTransaction(&Transaction{Action: "insert", Name: "leadb", Feature: point})
+	require.ErrorIs(t, err, errNotLeader)
+
+	// without a known leader writes are refused
+	b.eng.mu.Lock()
+	b.eng.leaderAddr = ""
+	b.eng.mu.Unlock()
+	require.Equal(t, http.StatusServiceUnavailable, serve(t, muxB, "POST", "/leadb/insert", encodePoint(point)).Code)
+}
+
+func TestElection(t *testing.T) {
+	names := []string{"elect1", "elect2", "elect3"}
+	for _, name := range names {
+		removeDB(t, name+"_geo.db")
+	}
+	muxes := make([]*swapMux, len(names))
+	addrs := make([]string, len(names))
+	for i, name := range names {
+		muxes[i] = &swapMux{}
+		muxes[i].Store(http.NewServeMux())
+		srv := httptest.NewServer(muxes[i])
+		t.Cleanup(srv.Close)
+		addrs[i] = srv.URL + "/" + name
+	}
+	nodes := make([]*Storage, len(names))
+	start := func(i int) {
+		var replicas []string
+		for j, addr := range addrs {
+			if j != i {
+				replicas = append(replicas, addr)
+			}
+		}
+		muxes[i].Store(http.NewServeMux())
+		nodes[i] = NewStorage(muxes[i].Load(), names[i], names[i]+"_geo.db.json", WithElection(addrs[i]), WithReplicas(replicas...))
+		nodes[i].Run()
+	}
+	// a killed node doesn't answer anything anymore
+	kill := func(i int) {
+		muxes[i].Store(http.NewServeMux())
+		nodes[i].Stop()
+		nodes[i] = nil
+	}
+	t.Cleanup(func() {
+		for i, node := range nodes {
+			if node != nil {
+				node.Stop()
+			}
+			removeDB(t, names[i]+"_geo.db")
+		}
+	})
+	leader := func(among ...int) int {
+		found := -1
+		require.Eventually(t, func() bool {
+			found = -1
+			for _, i := range among {
+				if ok, _ := nodes[i].eng.role(); ok {
+					found = i
+				}
+			}
+			if found < 0 {
+				return false
+			}
+			// every live node follows it
+			for _, i := range among {
+				if _, addr := nodes[i].eng.role(); addr != addrs[found] {
+					return false
+				}
+			}
+			return true
+		}, 10*time.Second, 10*time.Millisecond)
+		return found
+	}
+	term := func(i int) uint64 {
+		nodes[i].eng.mu.Lock()
+		defer nodes[i].eng.mu.Unlock()
+		return nodes[i].eng.term
+	}
+	insert := func(i int, id string) int {
+		point := geojson.NewFeature(orb.Point{1, 2})
+		point.ID = id
+		req, err := http.NewRequest("POST", "/"+names[i]+"/insert", bytes.NewReader(encodePoint(point)))
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		muxes[i].Load().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	found := func(i int, id string) bool {
+		return serve(t, muxes[i].Load(), "GET", "/"+names[i]+"/feature/"+id, nil).Code == http.StatusOK
+	}
+	others := func(i int) []int {
+		var rest []int
+		for j := range names {
+			if j != i {
+				rest = append(rest, j)
+			}
+		}
+		return rest
+	}
+
+	for i := range names {
+		start(i)
+	}
+	first := leader(0, 1, 2)
+	firstTerm := term(first)
+	require.Equal(t, http.StatusOK, insert(first, "committed"))
+	for _, i := range others(first) {
+		require.Equal(t, http.StatusTemporaryRedirect, insert(i, "refused"))
+		require.Eventually(t, func() bool { return found(i, "committed") }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// the leader dies and the others elect a new one in a later term
+	kill(first)
+	rest := others(first)
+	second := leader(rest...)
+	require.Greater(t, term(second), firstTerm)
+	require.Equal(t, http.StatusOK, insert(second, "after"))
+	follower := rest[0]
+	if follower == second {
+		follower = rest[1]
+	}
+	require.Eventually(t, func() bool { return found(follower, "after") }, 5*time.Second, 10*time.Millisecond)
+
+	// the old leader comes back as a follower and catches up
+	start(first)
+	require.Equal(t, second, leader(0, 1, 2))
+	require.Eventually(t, func() bool { return found(first, "after") }, 5*time.Second, 10*time.Millisecond)
+
+	// a leader cut off from its followers makes a write nobody gets, then dies
+	for _, i := range others(second) {
+		kill(i)
+	}
+	require.Equal(t, http.StatusOK, insert(second, "unreplicated"))
+	require.Eventually(t, func() bool { ok, _ := nodes[second].eng.role(); return !ok }, 5*time.Second, 10*time.Millisecond)
+	kill(second)
+
+	// the others elect a leader without it and write past its transaction
+	remaining := others(second)
+	for _, i := range remaining {
+		start(i)
+	}
+	third := leader(remaining...)
+	require.Equal(t, http.StatusOK, insert(third, "latest"))
+
+	// when it comes back its write is fenced off everywhere
+	start(second)
+	require.Equal(t, third, leader(0, 1, 2))
+	for i := range names {
+		require.Eventually(t, func() bool { return found(i, "latest") }, 5*time.Second, 10*time.Millisecond)
+		require.Eventually(t, func() bool { return !found(i, "unreplicated") }, 5*time.Second, 10*time.Millisecond)
+		require.True(t, found(i, "committed"))
+	}
+}
+
+func TestVote(t *testing.T) {
+	removeDB(t, "voter_geo.db")
+	storage := NewStorage(http.NewServeMux(), "voter", "voter_geo.db.json")
+	t.Cleanup(func() {
+		storage.Stop()
+		removeDB(t, "voter_geo.db")
+	})
+	storage.eng.mu.Lock()
+	storage.eng.vclock = map[string]uint64{"a": 5, "b": 3}
+	storage.eng.lastTerm = 2
+	storage.eng.mu.Unlock()
+
+	// more transactions in all, but missing some of b
+	resp := storage.eng.vote(&voteRequest{Term: 3, Candidate: "c1", LastTerm: 2, VClock: map[string]uint64{"a": 9, "b": 2}})
+	require.False(t, resp.Granted)
+	resp = storage.eng.vote(&voteRequest{Term: 4, Candidate: "c2", LastTerm: 2, VClock: map[string]uint64{"a": 5, "b": 3, "c": 1}})
+	require.True(t, resp.Granted)
+	// a newer last term is up to date whatever the clock
+	resp = storage.eng.vote(&voteRequest{Term: 5, Candidate: "c3", LastTerm: 3, VClock: map[string]uint64{}})
+	require.True(t, resp.Granted)
+}
+
+func TestWriteConcern(t *testing.T) {
+	names := []string{"concerna", "concernb", "concernc"}
+	for _, name := range names {
+		removeDB(t, name+"_geo.db")
+	}
+	muxes := make([]*swapMux, len(names))
+	addrs := make([]string, len(names))
+	for i, name := range names {
+		muxes[i] = &swapMux{}
+		muxes[i].Store(http.NewServeMux())
+		srv := httptest.NewServer(muxes[i])
+		t.Cleanup(srv.Close)
+		addrs[i] = srv.URL + "/" + name
+	}
+	nodes := []*Storage{
+		NewStorage(muxes[0].Load(), names[0], names[0]+"_geo.db.json", WithReplicas(addrs[1:]...), WithWriteConcern(WriteQuorum, time.Second)),
+		NewStorage(muxes[1].Load(), names[1], names[1]+"_geo.db.json", WithLeader(addrs[0]), WithReplicas(addrs[0])),
+		NewStorage(muxes[2].Load(), names[2], names[2]+"_geo.db.json", WithLeader(addrs[0]), WithReplicas(addrs[0])),
+	}
+	for _, node := range nodes {
+		node.Run()
+	}
+	t.Cleanup(func() {
+		for i, node := range nodes {
+			if node != nil {
+				node.Stop()
+			}
+			removeDB(t, names[i]+"_geo.db")
+		}
+	})
+	require.Eventually(t, func() bool {
+		nodes[0].eng.peersMu.Lock()
+		defer nodes[0].eng.peersMu.Unlock()
+		return len(nodes[0].eng.peers) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	insert := func(id, query string) *httptest.ResponseRecorder {
+		point := geojson.NewFeature(orb.Point{1, 2})
+		point.ID = id
+		return serve(t, muxes[0].Load(), "POST", "/concerna/insert"+query, encodePoint(point))
+	}
+	found := func(i int, id string) bool {
+		return serve(t, muxes[i].Load(), "GET", "/"+names[i]+"/feature/"+id, nil).Code == http.StatusOK
+	}
+
+	// once acknowledged with w=all, every replica has the write
+	require.Equal(t, http.StatusOK, insert("everywhere", "?w=all").Code)
+	require.True(t, found(1, "everywhere"))
+	require.True(t, found(2, "everywhere"))
+	require.Equal(t, http.StatusOK, insert("local", "?w=local").Code)
+	require.Equal(t, http.StatusBadRequest, insert("invalid", "?w=some").Code)
+	require.Equal(t, http.StatusBadRequest, insert("invalid", "?w=all&wtimeout=soon").Code)
+
+	// with a replica down the quorum is still reached, but not all of them
+	nodes[2].Stop()
+	nodes[2] = nil
+	muxes[2].Store(http.NewServeMux())
+	require.Eventually(t, func() bool {
+		nodes[0].eng.peersMu.Lock()
+		defer nodes[0].eng.peersMu.Unlock()
+		return len(nodes[0].eng.peers) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, http.StatusOK, insert("quorum", "").Code)
+	require.True(t, found(1, "quorum"))
+	rec := insert("all", "?w=all&wtimeout=200ms")
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "1", rec.Header().Get("X-Write-Acks"))
+	require.Contains(t, rec.Body.String(), "1 of 2 replicas acknowledged")
+	// with what a client needs to find it rather than insert it again
+	require.Contains(t, rec.Body.String(), `"id":"all"`)
+	require.NotEmpty(t, rec.Header().Get(tokenHeader))
+
+	// the write itself stays
+	require.Equal(t, http.StatusOK, serve(t, muxes[0].Load(), "GET", "/concerna/feature/all", nil).Code)
+}
+
+func TestReadRedirect(t *testing.T) {
+	names := []string{"reada", "readb", "readc"}
+	for _, name := range names {
+		removeDB(t, name+"_geo.db")
+	}
+	muxes := make([]*http.ServeMux, len(names))
+	addrs := make([]string, len(names))
+	for i, name := range names {
+		muxes[i] = http.NewServeMux()
+		srv := httptest.NewServer(muxes[i])
+		t.Cleanup(srv.Close)
+		addrs[i] = srv.URL + "/" + name
+	}
+	a := NewStorage(muxes[0], "reada", "reada_geo.db.json", WithReplicas(addrs[1:]...), WithReadThreshold(1))
+	// readb doesn't replicate and falls behind, readc keeps up
+	b := NewStorage(muxes[1], "readb", "readb_geo.db.json", WithLeader(addrs[0]))
+	c := NewStorage(muxes[2], "readc", "readc_geo.db.json", WithLeader(addrs[0]), WithReplicas(addrs[0]))
+	for _, s := range []*Storage{a, b, c} {
+		s.Run()
+	}
+	t.Cleanup(func() {
+		for i, s := range []*Storage{a, b, c} {
+			s.Stop()
+			removeDB(t, names[i]+"_geo.db")
+		}
+	})
+
+	for _, id := range []string{"one", "two"} {
+		point := geojson.NewFeature(orb.Point{1, 2})
+		point.ID = id
+		require.Equal(t, http.StatusOK, serve(t, muxes[0], "POST", "/reada/insert", encodePoint(point)).Code)
+	}
+	require.Eventually(t, func() bool {
+		return c.eng.clock()["reada"] == 2
+	}, time.Second, 10*time.Millisecond)
+	a.refresh()
+
+	read := func(query string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/reada/select"+query, nil)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		muxes[0].ServeHTTP(rec, req)
+		return rec
+	}
+	redirected := func(rec *httptest.ResponseRecorder) (string, url.Values) {
+		require.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+		u, err := url.Parse(rec.Header().Get("Location"))
+		require.NoError(t, err)
+		return u.Scheme + "://" + u.Host + u.Path, u.Query()
+	}
+
+	// under the threshold reads are served locally
+	require.Equal(t, http.StatusOK, read("").Code)
+
+	// over it the replica that keeps up is preferred
+	a.inflight.Store(1)
+	defer a.inflight.Store(0)
+	target, query := redirected(read("?rect=0,0,5,5"))
+	require.Equal(t, addrs[2]+"/select", target)
+	require.Equal(t, "1", query.Get("hops"))
+	require.Equal(t, "reada", query.Get("visited"))
+	require.Equal(t, "0,0,5,5", query.Get("rect"))
+
+	// visited replicas are skipped, stale ones may be refused
+	target, query = redirected(read("?hops=1&visited=readc"))
+	require.Equal(t, addrs[1]+"/select", target)
+	require.Equal(t, "2", query.Get("hops"))
+	require.Equal(t, "readc,reada", query.Get("visited"))
+	require.Equal(t, http.StatusOK, read("?hops=1&visited=readc&maxStaleness=1").Code)
+	require.Equal(t, http.StatusBadRequest, read("?maxStaleness=soon").Code)
+
+	// after too many hops the read is served wherever it is
+	require.Equal(t, http.StatusOK, read("?hops=3").Code)
+
+	// loaded replicas are not chosen
+	c.inflight.Store(5)
+	defer c.inflight.Store(0)
+	a.refresh()
+	target, _ = redirected(read(""))
+	require.Equal(t, addrs[1]+"/select", target)
+}
+
+func TestConsistencyToken(t *testing.T) {
+	names := []string{"tokena", "tokenb", "tokenc"}
+	for _, name := range names {
+		removeDB(t, name+"_geo.db")
+	}
+	muxes := make([]*http.ServeMux, len(names))
+	addrs := make([]string, len(names))
+	for i, name := range names {
+		muxes[i] = http.NewServeMux()
+		srv := httptest.NewServer(muxes[i])
+		t.Cleanup(srv.Close)
+		addrs[i] = srv.URL + "/" + name
+	}
+	a := NewStorage(muxes[0], "tokena", "tokena_geo.db.json")
+	b := NewStorage(muxes[1], "tokenb", "tokenb_geo.db.json", WithLeader(addrs[0]), WithReplicas(addrs[0]))
+	// tokenc never gets the writes
+	c := NewStorage(muxes[2], "tokenc", "tokenc_geo.db.json", WithLeader(addrs[0]))
+	for _, s := range []*Storage{a, b, c} {
+		s.Run()
+	}
+	t.Cleanup(func() {
+		for i, s := range []*Storage{a, b, c} {
+			s.Stop()
+			removeDB(t, names[i]+"_geo.db")
+		}
+	})
+
+	point := geojson.NewFeature(orb.Point{1, 2})
+	point.ID = "pin"
+	rec := serve(t, muxes[0], "POST", "/tokena/insert", encodePoint(point))
+	require.Equal(t, http.StatusOK, rec.Code)
+	token := rec.Header().Get(tokenHeader)
+	require.Equal(t, "tokena:1", token)
+
+	read := func(i int, query string, header string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/"+names[i]+"/select"+query, nil)
+		require.NoError(t, err)
+		if header != "" {
+			req.Header.Set(tokenHeader, header)
+		}
+		rec := httptest.NewRecorder()
+		muxes[i].ServeHTTP(rec, req)
+		return rec
+	}
+
+	// a replica answers once it has the write
+	rec = read(1, "?token="+token, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"pin"`)
+	require.Equal(t, http.StatusOK, read(1, "", token).Code)
+
+	// one that doesn't get it in time sends the read to the leader
+	rec = read(2, "?token="+token, "")
+	require.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	u, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, addrs[0]+"/select", u.Scheme+"://"+u.Host+u.Path)
+	require.Equal(t, token, u.Query().Get("token"))
+	require.Equal(t, "tokenc", u.Query().Get("visited"))
+
+	// nobody has a write from the future
+	require.Equal(t, http.StatusServiceUnavailable, read(0, "?token=tokena:5", "").Code)
+	require.Equal(t, http.StatusBadRequest, read(0, "?token=tokena", "").Code)
+}
+
+func TestConflicts(t *testing.T) {
+	for _, policy := range []ConflictPolicy{ConflictLWW, ConflictSiblings} {
+		t.Run(strconv.Itoa(int(policy)), func(t *testing.T) {
+			names := []string{"conflicta", "conflictb"}
+			muxes := make([]*http.ServeMux, len(names))
+			nodes := make([]*Storage, len(names))
+			for i, name := range names {
+				removeDB(t, name+"_geo.db")
+				muxes[i] = http.NewServeMux()
+				nodes[i] = NewStorage(muxes[i], name, name+"_geo.db.json", WithConflictPolicy(policy))
+				nodes[i].Run()
+			}
+			t.Cleanup(func() {
+				for i, node := range nodes {
+					node.Stop()
+					removeDB(t, names[i]+"_geo.db")
+				}
+			})
+
+			// the nodes are partitioned: transactions are shipped by hand
+			shipped := make([]int, len(names))
+			ship := func(from, to int) {
+				nodes[from].eng.mu.Lock()
+				txns := slices.Clone(nodes[from].eng.history[shipped[from]:])
+				nodes[from].eng.mu.Unlock()
+				for _, txn := range txns {
+					data, err := json.Marshal(txn)
+					require.NoError(t, err)
+					var copied Transaction
+					require.NoError(t, json.Unmarshal(data, &copied))
+					require.NoError(t, nodes[to].eng.replicate(&copied))
+				}
+			}
+			sync := func() {
+				counts := make([]int, len(names))
+				for i, node := range nodes {
+					node.eng.mu.Lock()
+					counts[i] = len(node.eng.history)
+					node.eng.mu.Unlock()
+				}
+				ship(0, 1)
+				ship(1, 0)
+				copy(shipped, counts)
+			}
+			replace := func(i int, color string) {
+				point := geojson.NewFeature(orb.Point{1, 2})
+				point.ID = "pin"
+				point.Properties["color"] = color
+				require.Equal(t, http.StatusOK, serve(t, muxes[i], "POST", "/"+names[i]+"/replace", encodePoint(point)).Code)
+			}
+			get := func(i int) *httptest.ResponseRecorder {
+				return serve(t, muxes[i], "GET", "/"+names[i]+"/feature/pin", nil)
+			}
+			conflicts := func(i int) map[string]json.RawMessage {
+				rec := serve(t, muxes[i], "GET", "/"+names[i]+"/conflicts", nil)
+				require.Equal(t, http.StatusOK, rec.Code)
+				var body map[string]json.RawMessage
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+				return body
+			}
+
+			point := geojson.NewFeature(orb.Point{1, 2})
+			point.ID = "pin"
+			require.Equal(t, http.StatusOK, serve(t, muxes[0], "POST", "/conflicta/insert", encodePoint(point)).Code)
+			sync()
+			require.Equal(t, http.StatusOK, get(1).Code)
+
+			// an edit made after seeing the other one is not a conflict
+			replace(1, "green")
+			sync()
+			require.Contains(t, get(0).Body.String(), "green")
+			require.JSONEq(t, `[]`, string(conflicts(0)["resolved"]))
+
+			// concurrent edits on both sides of the partition
+			replace(0, "red")
+			replace(1, "blue")
+			sync()
+
+			if policy == ConflictLWW {
+				// both nodes keep the later edit
+				require.Equal(t, http.StatusOK, get(0).Code)
+				require.Contains(t, get(0).Body.String(), "blue")
+				require.Contains(t, get(1).Body.String(), "blue")
+				for i := range names {
+					var resolved []resolution
+					require.NoError(t, json.Unmarshal(conflicts(i)["resolved"], &resolved))
+					require.Len(t, resolved, 1)
+					require.Equal(t, "conflictb", resolved[0].Winner.Name)
+					require.Equal(t, "conflicta", resolved[0].Loser.Name)
+				}
+				return
+			}
+
+			// both versions are kept until a merged one is written
+			for i := range names {
+				rec := get(i)
+				require.Equal(t, http.StatusMultipleChoices, rec.Code)
+				require.Contains(t, rec.Body.String(), "red")
+				require.Contains(t, rec.Body.String(), "blue")
+				var siblings map[string][]sibling
+				require.NoError(t, json.Unmarshal(conflicts(i)["siblings"], &siblings))
+				require.Len(t, siblings["pin"], 2)
+			}
+			require.Contains(t, serve(t, muxes[1], "GET", "/conflictb/select", nil).Body.String(), "blue")
+			replace(0, "purple")
+			sync()
+			for i := range names {
+				rec := get(i)
+				require.Equal(t, http.StatusOK, rec.Code)
+				require.Contains(t, rec.Body.String(), "purple")
+				require.JSONEq(t, `{}`, string(conflicts(i)["siblings"]))
+			}
+		})
+	}
+}
+
+func TestRepair(t *testing.T) {
+	names := []string{"repaira", "repairb"}
+	muxes := make([]*http.ServeMux, len(names))
+	addrs := make([]string, len(names))
+	for i, name := range names {
+		removeDB(t, name+"_geo.db")
+		muxes[i] = http.NewServeMux()
+		srv := httptest.NewServer(muxes[i])
+		t.Cleanup(srv.Close)
+		addrs[i] = srv.URL + "/" + name
+	}
+	a := NewStorage(muxes[0], "repaira", "repaira_geo.db.json", WithReplicas(addrs[1]))
+	b := NewStorage(muxes[1], "repairb", "repairb_geo.db.json", WithReplicas(addrs[0]))
+	a.Run()
+	b.Run()
+	t.Cleanup(func() {
+		a.Stop()
+		b.Stop()
+		for _, name := range names {
+			removeDB(t, name+"_geo.db")
+		}
+	})
+
+	for i := range 20 {
+		point := geojson.NewFeature(orb.Point{float64(i), 2})
+		point.ID = "pin" + strconv.Itoa(i)
+		require.Equal(t, http.StatusOK, serve(t, muxes[0], "POST", "/repaira/insert", encodePoint(point)).Code)
+	}
+	point := geojson.NewFeature(orb.Point{3, 3})
+	point.ID = "pin3"
+	require.Equal(t, http.StatusOK, serve(t, muxes[0], "POST", "/repaira/replace", encodePoint(point)).Code)
+	require.Equal(t, http.StatusOK, serve(t, muxes[0], "POST", "/repaira/delete", []byte(`{"id":"pin5"}`)).Code)
+	require.Eventually(t, func() bool {
+		return slices.Equal(a.eng.merkle()[0], b.eng.merkle()[0])
+	}, time.Second, 10*time.Millisecond)
+
+	repair := func(mux *http.ServeMux, url string) map[string]repairStats {
+		rec := serve(t, mux, "POST", url, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var body map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		stats := make(map[string]repairStats)
+		for _, key := range []string{"run", "total"} {
+			var s repairStats
+			require.NoError(t, json.Unmarshal(body[key], &s))
+			stats[key] = s
+		}
+		return stats
+	}
+	require.Equal(t, repairStats{Peers: 1}, repair(muxes[1], "/repairb/repair")["run"])
+
+	// b loses features without any log record of it
+	b.eng.mu.Lock()
+	b.eng.forget("pin1")
+	b.eng.forget("pin5")
+	stale := geojson.NewFeature(orb.Point{3, 2})
+	stale.ID = "pin3"
+	b.eng.applyTransaction(&Transaction{Action: "replace", Version: 1, Feature: stale})
+	b.eng.mu.Unlock()
+	require.NotEqual(t, a.eng.merkle()[0], b.eng.merkle()[0])
+
+	stats := repair(muxes[1], "/repairb/repair")
+	require.Equal(t, 3, stats["run"].Fixed)
+	require.LessOrEqual(t, stats["run"].Buckets, 3)
+	require.Equal(t, 3, stats["total"].Fixed)
+	require.Equal(t, a.eng.merkle(), b.eng.merkle())
+	require.Equal(t, http.StatusOK, serve(t, muxes[1], "GET", "/repairb/feature/pin1", nil).Code)
+	require.Contains(t, serve(t, muxes[1], "GET", "/repairb/trash", nil).Body.String(), `"pin5"`)
+
+	// the repairs are logged, without a checkpoint
+	history := b.eng.featureHistory("pin1")
+	require.NotEmpty(t, history)
+	require.True(t, history[len(history)-1].Repair)
+	replayed := NewStorage(http.NewServeMux(), "repairb", "repairb_geo.db.json")
+	require.Equal(t, b.eng.merkle(), replayed.eng.merkle())
+	replayed.Stop()
+
+	// the same version with other content is tied, the same way on both
+	b.eng.mu.Lock()
+	rec := b.eng.primary["pin7"]
+	changed := geojson.NewFeature(rec.feature.Geometry)
+	changed.ID = "pin7"
+	changed.Properties["n"] = 1
+	rec.feature = changed
+	b.eng.mu.Unlock()
+	require.NoError(t, b.eng.check())
+	require.NotEqual(t, a.eng.merkle(), b.eng.merkle())
+	fixed := repair(muxes[0], "/repaira/repair")["run"].Fixed + repair(muxes[1], "/repairb/repair")["run"].Fixed
+	require.Equal(t, 1, fixed)
+	require.Equal(t, a.eng.merkle(), b.eng.merkle())
+	require.Zero(t, repair(muxes[0], "/repaira/repair")["run"].Fixed+repair(muxes[1], "/repairb/repair")["run"].Fixed)
+
+	// the repair survives a restart
+	b.Stop()
+	muxes[1] = http.NewServeMux()
+	b = NewStorage(muxes[1], "repairb", "repairb_geo.db.json")
+	b.Run()
+	require.Equal(t, a.eng.merkle(), b.eng.merkle())
+
+	// a's own repair finds nothing newer on b
+	require.Equal(t, 0, repair(muxes[0], "/repaira/repair")["run"].Fixed)
+}
+
+func TestRouter(t *testing.T) {
+	mux := http.NewServeMux()
+	// several shards used to panic registering the routes twice
+	startCluster(t, mux, []string{"west", "east"}, nil, nil)
+
+	features := map[string]orb.Geometry{
+		"w":       orb.Point{-10, 5},
+		"e":       orb.Point{10, 5},
+		"spans-e": orb.LineString{{-10, 0}, {30, 0}},
+		"spans-w": orb.LineString{{-30, 0}, {10, 0}},
+		"border":  orb.LineString{{-10, 0}, {10, 0}},
+	}
+	want := map[string]string{"w": "/west", "e": "/east", "spans-e": "/east", "spans-w": "/west", "border": "/west"}
+	for id, geometry := range features {
+		feature := geojson.NewFeature(geometry)
+		feature.ID = id
+		req, err := http.NewRequest("POST", "/insert", bytes.NewReader(encodePoint(feature)))
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+		require.Equal(t, want[id]+"/insert", rec.Header().Get("Location"), id)
+		require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/insert", encodePoint(feature)).Code)
+	}
+	require.Equal(t, http.StatusOK, serve(t, mux, "GET", "/east/feature/spans-e", nil).Code)
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "GET", "/west/feature/spans-e", nil).Code)
+
+	// reads by id are routed to the shard that has the feature
+	rec := serve(t, mux, "GET", "/feature/e", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"e"`)
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "GET", "/feature/nope", nil).Code)
+
+	// a select over both sectors merges the shards
+	rec = serve(t, mux, "GET", "/select", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	col, err := geojson.UnmarshalFeatureCollection(rec.Body.Bytes())
+	require.NoError(t, err)
+	var ids []string
+	for _, f := range col.Features {
+		ids = append(ids, f.ID.(string))
+	}
+	require.Equal(t, []string{"border", "e", "spans-e", "spans-w", "w"}, ids)
+	rec = serve(t, mux, "GET", "/select?rect=0,0,20,20", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"e"`)
+	require.NotContains(t, rec.Body.String(), `"w"`)
+
+	// deletes find the shard and undeletes find it in the trash
+	body, _ := json.Marshal(map[string]string{"id": "e"})
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/delete", body).Code)
+	require.Contains(t, serve(t, mux, "GET", "/trash", nil).Body.String(), `"e"`)
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/undelete", body).Code)
+
+	rec = serve(t, mux, "POST", "/features:get", []byte(`{"ids":["w","e","nope"]}`))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"missing":["nope"]`)
+}
+
+func TestScatterGather(t *testing.T) {
+	mux := http.NewServeMux()
+	table := NewRoutingTable()
+	table.Add(orb.Bound{Min: orb.Point{-180, -90}, Max: orb.Point{0, 90}}, &Shard{LeaderAddr: "/sga"})
+	table.Add(orb.Bound{Min: orb.Point{0, -90}, Max: orb.Point{90, 90}}, &Shard{LeaderAddr: "/sgb"})
+	// nothing listens there
+	table.Add(orb.Bound{Min: orb.Point{90, -90}, Max: orb.Point{180, 90}}, &Shard{LeaderAddr: "http://127.0.0.1:1/down"})
+	startCluster(t, mux, []string{"sga", "sgb"}, nil, table)
+
+	insert := func(path, id string, x float64, rank float64) {
+		feature := geojson.NewFeature(orb.Point{x, 1})
+		feature.ID = id
+		feature.Properties["rank"] = rank
+		require.Equal(t, http.StatusOK, serve(t, mux, "POST", path, encodePoint(feature)).Code)
+	}
+	insert("/insert", "a1", -20, 3)
+	insert("/insert", "a2", -10, 1)
+	insert("/insert", "b1", 10, 2)
+	insert("/insert", "b2", 20, 4)
+	// a stale copy of a1 left on the wrong shard
+	insert("/sgb/insert", "a1", 30, 0)
+
+	ids := func(rec *httptest.ResponseRecorder) []string {
+		col, err := geojson.UnmarshalFeatureCollection(rec.Body.Bytes())
+		require.NoError(t, err)
+		var ids []string
+		for _, f := range col.Features {
+			ids = append(ids, f.ID.(string))
+			if f.ID == "a1" {
+				require.Equal(t, -20.0, f.Point().X())
+			}
+		}
+		return ids
+	}
+
+	rec := serve(t, mux, "GET", "/select?rect=-50,-50,50,50", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, rec.Header().Get(missingShardsHeader))
+	require.Equal(t, []string{"a1", "a2", "b1", "b2"}, ids(rec))
+
+	rec = serve(t, mux, "GET", "/select?rect=-50,-50,50,50&sort=-rank&limit=3", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, []string{"b2", "a1", "b1"}, ids(rec))
+
+	// one shard only, but sorted and limited by the Router
+	rec = serve(t, mux, "GET", "/select?rect=-50,-50,-1,50&sort=rank&limit=1", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, []string{"a2"}, ids(rec))
+
+	// the whole map reaches the shard that is down
+	rec = serve(t, mux, "GET", "/select?sort=id", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "http://127.0.0.1:1/down", rec.Header().Get(missingShardsHeader))
+	require.Equal(t, []string{"a1", "a2", "b1", "b2"}, ids(rec))
+	require.Equal(t, http.StatusBadGateway, serve(t, mux, "GET", "/select?strict=true", nil).Code)
+
+	require.Equal(t, http.StatusBadRequest, serve(t, mux, "GET", "/select?limit=-1", nil).Code)
+	require.Equal(t, http.StatusBadRequest, serve(t, mux, "GET", "/select?strict=maybe", nil).Code)
+}
+
+func TestProxy(t *testing.T) {
+	backend := http.NewServeMux()
+	removeDB(t, "proxied_geo.db")
+	storage := NewStorage(backend, "proxied", "proxied_geo.db.json")
+	storage.Run()
+
+	var failures, drops atomic.Int32
+	var ids []string
+	var idsMu sync.Mutex
+	seen := func() []string {
+		idsMu.Lock()
+		defer idsMu.Unlock()
+		return slices.Clone(ids)
+	}
+	forget := func() {
+		idsMu.Lock()
+		defer idsMu.Unlock()
+		ids = nil
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idsMu.Lock()
+		ids = append(ids, r.Header.Get(requestIDHeader))
+		idsMu.Unlock()
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/slow"):
+			time.Sleep(300 * time.Millisecond)
+		case drops.Add(-1) >= 0:
+			// the connection is closed without an answer
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+		case failures.Add(-1) >= 0:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		default:
+			backend.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		storage.Stop()
+		removeDB(t, "proxied_geo.db")
+	})
+
+	mux := http.NewServeMux()
+	table := NewRoutingTable()
+	table.Add(world, &Shard{LeaderAddr: srv.URL + "/proxied"})
+	router := NewRouter(mux, table, WithProxy(100*time.Millisecond, 2), WithHealthChecks(0))
+	router.Run()
+	t.Cleanup(router.Stop)
+
+	// answered by the Router itself, with a request id passed to the Storage
+	feature := geojson.NewFeature(orb.Point{1, 2})
+	feature.ID = "pin"
+	req, err := http.NewRequest("POST", "/insert", bytes.NewReader(encodePoint(feature)))
+	require.NoError(t, err)
+	req.Header.Set(requestIDHeader, "client-id")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "client-id", rec.Header().Get(requestIDHeader))
+	require.Equal(t, []string{"client-id"}, seen())
+
+	rec = serve(t, mux, "GET", "/feature/pin", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotEmpty(t, rec.Header().Get(requestIDHeader))
+	require.Equal(t, rec.Header().Get(requestIDHeader), seen()[1])
+
+	// reads are retried, with the same request id
+	forget()
+	failures.Store(2)
+	rec = serve(t, mux, "GET", "/select", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"pin"`)
+	require.Len(t, seen(), 3)
+	require.Equal(t, seen()[0], seen()[2])
+
+	failures.Store(3)
+	require.Equal(t, http.StatusServiceUnavailable, serve(t, mux, "GET", "/select", nil).Code)
+
+	// also when the connection breaks
+	forget()
+	drops.Store(2)
+	rec = serve(t, mux, "GET", "/select", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Contains(t, rec.Body.String(), `"pin"`)
+	require.GreaterOrEqual(t, len(seen()), 3)
+	for _, id := range seen() {
+		require.Equal(t, seen()[0], id)
+	}
+	drops.Store(100)
+	require.Equal(t, http.StatusBadGateway, serve(t, mux, "GET", "/select", nil).Code)
+	drops.Store(0)
+
+	// writes are not
+	forget()
+	failures.Store(1)
+	require.Equal(t, http.StatusServiceUnavailable, serve(t, mux, "POST", "/replace", encodePoint(feature)).Code)
+	require.Len(t, seen(), 1)
+	failures.Store(0)
+
+	rec = httptest.NewRecorder()
+	router.forward(rec, httptest.NewRequest("GET", "/", nil), srv.URL+"/slow")
+	require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+}
+
+func TestShardingStrategies(t *testing.T) {
+	shards := func(n int) []*Shard {
+		var out []*Shard
+		for i := range n {
+			out = append(out, &Shard{LeaderAddr: "/s" + strconv.Itoa(i)})
+		}
+		return out
+	}
+	locate := func(table *RoutingTable, id string, p orb.Point) string {
+		shard, err := table.Locate(id, p.Bound())
+		require.NoError(t, err)
+		return shard.LeaderAddr
+	}
+	corners := []orb.Point{{-90, -45}, {-90, 45}, {90, -45}, {90, 45}}
+
+	grid := NewShardedTable(&GridStrategy{Columns: 2, Rows: 2}, shards(4))
+	geohash := NewShardedTable(&GeohashStrategy{Precision: 1}, shards(4))
+	for i, p := range corners {
+		require.Equal(t, "/s"+strconv.Itoa(i), locate(grid, "", p))
+		require.Equal(t, "/s"+strconv.Itoa(i), locate(geohash, "", p))
+	}
+	require.Len(t, geohash.Overlapping(&orb.Bound{Min: orb.Point{-100, -50}, Max: orb.Point{-80, -40}}), 1)
+
+	// a city full of features is split between shards
+	var sample []orb.Point
+	for i := range 200 {
+		sample = append(sample, orb.Point{37.5 + float64(i%20)*0.01, 55.6 + float64(i/20)*0.02})
+	}
+	quadtree := NewShardedTable(NewQuadtreeStrategy(sample, 20, 16), shards(2))
+	city := map[string]bool{}
+	for _, p := range sample {
+		city[locate(quadtree, "", p)] = true
+	}
+	require.Len(t, city, 2)
+
+	// ids keep their shard when one is added, unless the new one takes them
+	hash := NewShardedTable(&HashStrategy{}, shards(3))
+	more := NewShardedTable(&HashStrategy{}, shards(4))
+	counts := map[string]int{}
+	for i := range 300 {
+		id := "pin" + strconv.Itoa(i)
+		owner := locate(hash, id, orb.Point{0, 0})
+		require.Equal(t, owner, locate(hash, id, orb.Point{50, 50}))
+		counts[owner]++
+		if moved := locate(more, id, orb.Point{0, 0}); moved != owner {
+			require.Equal(t, "/s3", moved)
+		}
+	}
+	require.Len(t, counts, 3)
+	require.Len(t, hash.Overlapping(&orb.Bound{}), 3)
+
+	// the strategy and the sectors are saved with the table
+	for _, table := range []*RoutingTable{grid, geohash, quadtree, hash} {
+		path := filepath.Join(t.TempDir(), "routing.json")
+		require.NoError(t, table.Save(path))
+		loaded, err := LoadRoutingTable(path)
+		require.NoError(t, err)
+		require.Equal(t, table.strategy.Kind(), loaded.strategy.Kind())
+		require.Len(t, loaded.sectors, len(table.sectors))
+		for i, p := range append(corners, sample...) {
+			id := "pin" + strconv.Itoa(i)
+			require.Equal(t, locate(table, id, p), locate(loaded, id, p))
+		}
+	}
+}
+
+func TestRouterHashStrategy(t *testing.T) {
+	mux := http.NewServeMux()
+	table := NewShardedTable(&HashStrategy{}, []*Shard{{LeaderAddr: "/ha"}, {LeaderAddr: "/hb"}})
+	startCluster(t, mux, []string{"ha", "hb"}, []StorageOption{WithIDPolicy(IDRequire)}, table)
+
+	// the Router makes the id it routes by
+	rec := serve(t, mux, "POST", "/insert", []byte(`{"type":"Feature","geometry":{"type":"Point","coordinates":[1,2]},"properties":{}}`))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.NoError(t, uuid.Validate(resp.ID))
+	owner := table.Owner(resp.ID)
+	require.Equal(t, http.StatusOK, serve(t, mux, "GET", owner.LeaderAddr+"/feature/"+resp.ID, nil).Code)
+
+	req := httptest.NewRequest("GET", "/feature/"+resp.ID, nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	require.Equal(t, owner.LeaderAddr+"/feature/"+resp.ID, rec.Header().Get("Location"))
+}
+
+func TestRebalance(t *testing.T) {
+	mux := http.NewServeMux()
+	tablePath := filepath.Join(t.TempDir(), "routing.json")
+	_, router := startCluster(t, mux, []string{"ra", "rb"}, nil, nil, WithTablePath(tablePath))
+
+	write := func(path, id string, x float64, n int) {
+		feature := geojson.NewFeature(orb.Point{x, 10})
+		feature.ID = id
+		feature.Properties["n"] = n
+		rec := serve(t, mux, "POST", path, encodePoint(feature))
+		// redirected to the old shard just before the cutover
+		for rec.Code == http.StatusMisdirectedRequest {
+			rec = serve(t, mux, "POST", path, encodePoint(feature))
+		}
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	ids := []string{}
+	for i := range 10 {
+		id := "f" + strconv.Itoa(i)
+		write("/insert", id, -175+float64(i)*17, 0)
+		ids = append(ids, id)
+	}
+	on := func(storage, id string) bool {
+		return serve(t, mux, "GET", "/"+storage+"/feature/"+id, nil).Code == http.StatusOK
+	}
+	selectAll := func() []string {
+		col, err := geojson.UnmarshalFeatureCollection(serve(t, mux, "GET", "/select", nil).Body.Bytes())
+		require.NoError(t, err)
+		var got []string
+		for _, f := range col.Features {
+			got = append(got, f.ID.(string))
+		}
+		slices.Sort(got)
+		return got
+	}
+	rebalance := func(path string, body any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		return serve(t, mux, "POST", path, data)
+	}
+
+	// a writer keeps changing a moving feature during the split
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 1; n <= 30; n++ {
+			write("/replace", "f9", -22, n)
+		}
+	}()
+	rec := rebalance("/rebalance/split", map[string]any{"sector": [4]float64{-180, -90, 0, 90}, "to": "/rb"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	<-done
+
+	for i, id := range ids {
+		west := -175+float64(i)*17 <= -90
+		require.Equal(t, west, on("ra", id), id)
+		require.Equal(t, !west, on("rb", id), id)
+	}
+	rec = serve(t, mux, "GET", "/feature/f9", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"n":30`)
+	require.Equal(t, []string{"f0", "f1", "f2", "f3", "f4", "f5", "f6", "f7", "f8", "f9"}, selectAll())
+
+	// the table is saved and the migration is over
+	saved, err := LoadRoutingTable(tablePath)
+	require.NoError(t, err)
+	require.Len(t, saved.sectors, 3)
+	_, err = os.Stat(tablePath + ".migration")
+	require.True(t, os.IsNotExist(err))
+
+	// merging the cold halves moves the features back
+	rec = rebalance("/rebalance/merge", map[string]any{"sectors": [][4]float64{{-180, -90, -90, 90}, {-90, -90, 0, 90}}})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	for _, id := range ids[:6] {
+		require.True(t, on("ra", id), id)
+	}
+	require.False(t, on("rb", "f9"))
+	require.Len(t, router.routes().sectors, 2)
+	require.Equal(t, http.StatusBadRequest, rebalance("/rebalance/merge", map[string]any{"sectors": [][4]float64{{-180, -90, 0, 90}, {1, 2, 3, 4}}}).Code)
+
+	// a migration saved before a crash is resumed
+	sector := orb.Bound{Min: orb.Point{-180, -90}, Max: orb.Point{0, 90}}
+	next, err := router.routes().Assign(sector, router.routes().shard("/rb"))
+	require.NoError(t, err)
+	require.NoError(t, router.save(&migration{Phase: phaseCopy, Sector: fromBound(sector), From: "/ra", To: "/rb", Moved: []string{}, Next: next}))
+	router.resume()
+	router.moveMu.Lock()
+	router.moveMu.Unlock()
+	for _, id := range ids {
+		require.False(t, on("ra", id), id)
+		require.True(t, on("rb", id), id)
+	}
+	rec = serve(t, mux, "GET", "/rebalance", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"phase":"done"`)
+	require.Equal(t, []string{"f0", "f1", "f2", "f3", "f4", "f5", "f6", "f7", "f8", "f9"}, selectAll())
+
+	// a hold keeps the history through a checkpoint without retention
+	exportToken := func(query string) string {
+		rec := serve(t, mux, "GET", "/rb/export?"+query, nil)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var out shardExport
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return out.Token
+	}
+	token := exportToken("hold=m1")
+	write("/rb/replace", "f0", -175, 1)
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/rb/checkpoint", nil).Code)
+	rec = serve(t, mux, "GET", "/rb/export?hold=m1&after="+url.QueryEscape(token), nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Contains(t, rec.Body.String(), `"f0"`)
+
+	// a fenced sector refuses the writes on the old shard until released
+	require.Equal(t, http.StatusOK, rebalance("/rb/hold/m1", map[string]any{"fence": [4]float64{-180, -90, -90, 90}}).Code)
+	feature := geojson.NewFeature(orb.Point{-175, 10})
+	feature.ID = "f0"
+	require.Equal(t, http.StatusMisdirectedRequest, serve(t, mux, "POST", "/rb/replace", encodePoint(feature)).Code)
+	write("/rb/replace", "f9", -22, 31)
+	require.Equal(t, http.StatusOK, serve(t, mux, "DELETE", "/rb/hold/m1", nil).Code)
+	write("/rb/replace", "f0", -175, 2)
+
+	// without the hold the checkpoint drops the history again
+	token = exportToken("")
+	write("/rb/replace", "f0", -175, 3)
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/rb/checkpoint", nil).Code)
+	require.Equal(t, http.StatusGone, serve(t, mux, "GET", "/rb/export?after="+url.QueryEscape(token), nil).Code)
+}
+
+func TestMetadata(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	meta := server.URL + "/meta"
+	removeDB(t, "meta_geo.db")
+	metadata := NewStorage(mux, "meta", "meta_geo.db.json", WithMetadataStore())
+	metadata.Run()
+	t.Cleanup(func() {
+		metadata.Stop()
+		removeDB(t, "meta_geo.db")
+	})
+
+	// the first Router publishes its table, the second one takes it
+	table := NewShardedTable(&GridStrategy{Columns: 2, Rows: 1}, []*Shard{{LeaderAddr: server.URL + "/ma"}, {LeaderAddr: server.URL + "/mb"}})
+	storages, _ := startCluster(t, mux, []string{"ma", "mb"}, []StorageOption{WithRoutingWatch(meta)}, table, WithProxy(0, 0), WithMetadata(meta))
+	mux2 := http.NewServeMux()
+	router2 := NewRouter(mux2, NewGridTable([][]string{{"nowhere"}}), WithProxy(0, 0), WithMetadata(meta))
+	t.Cleanup(router2.Stop)
+	router2.Run()
+	require.Len(t, router2.routes().Shards(), 2)
+	rec := serve(t, mux2, "GET", "/rebalance", nil)
+	require.Contains(t, rec.Body.String(), `"version":1`)
+
+	// the second Router stops watching and misses the move of the east
+	router2.Stop()
+	data, _ := json.Marshal(map[string]any{"sector": [4]float64{0, -90, 180, 90}, "to": server.URL + "/ma"})
+	rec = serve(t, mux, "POST", "/rebalance/move", data)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Eventually(t, func() bool {
+		a, _ := storages[0].routing.current()
+		b, _ := storages[1].routing.current()
+		return a == 2 && b == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the old shard tells it to refresh, the retry goes to the new one
+	feature := geojson.NewFeature(orb.Point{10, 10})
+	feature.ID = "east"
+	rec = serve(t, mux2, "POST", "/insert", encodePoint(feature))
+	require.Equal(t, http.StatusMisdirectedRequest, rec.Code)
+	require.Equal(t, "2", rec.Header().Get(routingVersionHeader))
+	rec = serve(t, mux2, "POST", "/insert", encodePoint(feature))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	resp, err := http.Get(server.URL + "/ma/feature/east")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// watches time out unchanged, stale publishes are refused
+	resp, err = http.Get(meta + "/routing?after=2&wait=10ms")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	body, _ := json.Marshal(map[string]any{"version": 1, "table": table})
+	req, _ := http.NewRequest("PUT", meta+"/routing", bytes.NewReader(body))
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	// the table is only reached through /routing
+	rec = serve(t, mux, "GET", "/meta/select", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotContains(t, rec.Body.String(), routingFeature)
+	require.Equal(t, http.StatusBadRequest, serve(t, mux, "GET", "/meta/feature/"+routingFeature, nil).Code)
+	require.Equal(t, http.StatusBadRequest, serve(t, mux, "POST", "/meta/delete", []byte(`{"id":"`+routingFeature+`"}`)).Code)
+	version, _ := storages[0].routing.current()
+	require.Equal(t, uint64(2), version)
+	// data shards keep no table, the id is theirs to use
+	named := geojson.NewFeature(orb.Point{20, 10})
+	named.ID = routingFeature
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/mb/insert", encodePoint(named)).Code)
+	require.Equal(t, http.StatusOK, serve(t, mux, "GET", "/mb/feature/"+routingFeature, nil).Code)
+	require.Contains(t, serve(t, mux, "GET", "/mb/select?rect=19,9,21,11", nil).Body.String(), routingFeature)
+
+	// deletes and patches routed with an old table are refused too
+	stray := geojson.NewFeature(orb.Point{20, 10})
+	stray.ID = "stray"
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/mb/insert", encodePoint(stray)).Code)
+	stale := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(routingVersionHeader, "1")
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	rec = stale("PATCH", "/mb/feature/stray", mergePatchType, `{"properties":{"n":1}}`)
+	require.Equal(t, http.StatusMisdirectedRequest, rec.Code)
+	require.Equal(t, "2", rec.Header().Get(routingVersionHeader))
+	rec = stale("POST", "/mb/delete", "application/json", `{"id":"stray"}`)
+	require.Equal(t, http.StatusMisdirectedRequest, rec.Code)
+	require.Equal(t, http.StatusOK, serve(t, mux, "GET", "/mb/feature/stray", nil).Code)
+}
+
+func TestCrossShardMove(t *testing.T) {
+	mux := http.NewServeMux()
+	_, router := startCluster(t, mux, []string{"va", "vb"}, nil, nil, WithTablePath(filepath.Join(t.TempDir(), "routing.json")))
+
+	pin := func(id string, x float64) []byte {
+		feature := geojson.NewFeature(orb.Point{x, 10})
+		feature.ID = id
+		return encodePoint(feature)
+	}
+	on := func(storage, id string) bool {
+		return serve(t, mux, "GET", "/"+storage+"/feature/"+id, nil).Code == http.StatusOK
+	}
+	selectAll := func() map[string]float64 {
+		col, err := geojson.UnmarshalFeatureCollection(serve(t, mux, "GET", "/select", nil).Body.Bytes())
+		require.NoError(t, err)
+		got := map[string]float64{}
+		for _, f := range col.Features {
+			require.NotContains(t, got, f.ID)
+			got[f.ID.(string)] = f.Geometry.(orb.Point).X()
+		}
+		return got
+	}
+
+	// a replace dragging the pin east moves it to the east shard
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/insert", pin("pin", -10)).Code)
+	require.True(t, on("va", "pin"))
+	rec := serve(t, mux, "POST", "/replace", pin("pin", 10))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.False(t, on("va", "pin"))
+	require.True(t, on("vb", "pin"))
+	require.Equal(t, map[string]float64{"pin": 10}, selectAll())
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/replace", pin("pin", 20)).Code)
+	require.Equal(t, map[string]float64{"pin": 20}, selectAll())
+
+	// moves interrupted with copies on both shards show only one of them
+	for _, id := range []string{"prepared", "committed"} {
+		require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/va/insert", pin(id, -10)).Code)
+		require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/vb/insert", pin(id, 10)).Code)
+	}
+	require.NoError(t, router.setIntent("prepared", &moveIntent{Phase: movePrepare, From: "/va", To: "/vb"}))
+	require.NoError(t, router.setIntent("committed", &moveIntent{Phase: moveCommit, From: "/va", To: "/vb"}))
+	require.Equal(t, map[string]float64{"pin": 20, "prepared": -10, "committed": 10}, selectAll())
+	rec = serve(t, mux, "GET", "/feature/committed", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "[10,10]")
+	require.Equal(t, http.StatusConflict, serve(t, mux, "POST", "/replace", pin("prepared", 30)).Code)
+
+	// a restarted Router rolls the prepared move back, the committed forward
+	router.movesMu.Lock()
+	clear(router.moves)
+	router.movesMu.Unlock()
+	router.resumeMoves()
+	require.False(t, router.movesPending())
+	require.True(t, on("va", "prepared"))
+	require.False(t, on("vb", "prepared"))
+	require.False(t, on("va", "committed"))
+	require.True(t, on("vb", "committed"))
+	require.Equal(t, map[string]float64{"pin": 20, "prepared": -10, "committed": 10}, selectAll())
+}
+
+func TestHealth(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	removeDB(t, "hb_geo.db")
+	removeDB(t, "hc_geo.db")
+	replica := NewStorage(mux, "hb", "hb_geo.db.json")
+	replica.Run()
+	stopped := NewStorage(mux, "hc", "hc_geo.db.json")
+	stopped.Run()
+	stopped.Stop()
+
+	rec := serve(t, mux, "GET", "/hb/health", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var health map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &health))
+	require.Equal(t, "ok", health["status"])
+	require.Equal(t, "running", health["engine"])
+	require.Equal(t, true, health["disk"].(map[string]any)["ok"])
+	rec = serve(t, mux, "GET", "/hc/health", nil)
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Contains(t, rec.Body.String(), `"status":"failing"`)
+
+	// the leader is down, reads go to the replica
+	dead := "http://127.0.0.1:1/ha"
+	table := NewRoutingTable()
+	table.Add(world, &Shard{LeaderAddr: dead, Replicas: []string{server.URL + "/hb"}})
+	routerMux := http.NewServeMux()
+	router := NewRouter(routerMux, table, WithProxy(time.Second, 0), WithHealthChecks(10*time.Millisecond))
+	router.Run()
+	t.Cleanup(func() {
+		router.Stop()
+		replica.Stop()
+		removeDB(t, "hb_geo.db")
+		removeDB(t, "hc_geo.db")
+	})
+	require.Eventually(t, func() bool { return !router.healthy(dead) }, 5*time.Second, 10*time.Millisecond)
+	rec = serve(t, routerMux, "GET", "/cluster", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var cluster struct {
+		Shards []struct {
+			RouteTo string `json:"routeTo"`
+		} `json:"shards"`
+		Nodes map[string]nodeState `json:"nodes"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &cluster))
+	require.Equal(t, server.URL+"/hb", cluster.Shards[0].RouteTo)
+	require.False(t, cluster.Nodes[dead].Healthy)
+	require.True(t, cluster.Nodes[server.URL+"/hb"].Healthy)
+	require.Contains(t, string(cluster.Nodes[server.URL+"/hb"].Report), `"status":"ok"`)
+	require.Equal(t, http.StatusOK, serve(t, routerMux, "GET", "/select", nil).Code)
+
+	// nodes flip only after several outcomes in a row
+	node := "/flapping"
+	for range downAfter - 1 {
+		router.observe(node, errors.New("refused"))
+	}
+	router.observe(node, nil)
+	router.observe(node, errors.New("refused"))
+	require.True(t, router.healthy(node))
+	for range downAfter {
+		router.observe(node, errors.New("refused"))
+	}
+	require.False(t, router.healthy(node))
+	for range upAfter - 1 {
+		router.observe(node, nil)
+	}
+	require.False(t, router.healthy(node))
+	router.observe(node, nil)
+	require.True(t, router.healthy(node))
+}
+
+func TestImport(t *testing.T) {
+	mux := http.NewServeMux()
+	table := NewGridTable([][]string{{"ia"}, {"ib"}})
+	_, router := startCluster(t, mux, []string{"ia", "ib"}, nil, table, WithTablePath(filepath.Join(t.TempDir(), "routing.json")))
+
+	pin := func(id string, x float64) string {
+		feature := geojson.NewFeature(orb.Point{x, 10})
+		feature.ID = id
+		return string(encodePoint(feature))
+	}
+	load := func(id, contentType string, lines []string) (int, importState) {
+		body := strings.Join(lines, "\n")
+		if contentType == "application/geo+json" {
+			body = `{"type":"FeatureCollection","name":{"skipped":[1]},"features":[` + strings.Join(lines, ",") + `]}`
+		}
+		req, err := http.NewRequest("POST", "/import?id="+id, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		var state importState
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &state), rec.Body.String())
+		return rec.Code, state
+	}
+
+	// features go to the shards of their sectors, in one batch each
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/ib/insert", []byte(pin("dup", 10))).Code)
+	lines := []string{pin("w0", -10), pin("w1", -20), pin("e0", 10), pin("e1", 20), pin("dup", 30), "not json", pin("far", 500), pin("e2", 40)}
+	code, state := load("first", "application/x-ndjson", lines)
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, state.Done)
+	require.Equal(t, 8, state.Read)
+	require.Equal(t, 2, state.Rejected)
+	require.Equal(t, shardImport{Inserted: 2}, *state.Shards["/ia"])
+	require.Equal(t, shardImport{Inserted: 3, Duplicates: 1}, *state.Shards["/ib"])
+	for _, id := range []string{"w0", "w1"} {
+		require.Equal(t, http.StatusOK, serve(t, mux, "GET", "/ia/feature/"+id, nil).Code)
+	}
+	for _, id := range []string{"e0", "e1", "e2"} {
+		require.Equal(t, http.StatusOK, serve(t, mux, "GET", "/ib/feature/"+id, nil).Code)
+	}
+	// a finished import isn't done again
+	code, again := load("first", "application/x-ndjson", lines)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, state, again)
+	rec := serve(t, mux, "GET", "/import/first", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "GET", "/import/none", nil).Code)
+
+	// a shard failing stops the import, resumed with the same id
+	broken := NewRoutingTable()
+	broken.Add(orb.Bound{Min: orb.Point{-180, -90}, Max: orb.Point{0, 90}}, &Shard{LeaderAddr: "/ia"})
+	broken.Add(orb.Bound{Min: orb.Point{0, -90}, Max: orb.Point{180, 90}}, &Shard{LeaderAddr: "/gone"})
+	router.table.Store(broken)
+	anonymous := func(x float64) string {
+		return string(encodePoint(geojson.NewFeature(orb.Point{x, 10})))
+	}
+	count := func(storage string) int {
+		col, err := geojson.UnmarshalFeatureCollection(serve(t, mux, "GET", "/"+storage+"/select", nil).Body.Bytes())
+		require.NoError(t, err)
+		return len(col.Features)
+	}
+	before := count("ia")
+	collection := []string{pin("w2", -30), anonymous(-40), pin("e3", 50), anonymous(60)}
+	code, state = load("second", "application/geo+json", collection)
+	require.Equal(t, http.StatusBadGateway, code)
+	require.False(t, state.Done)
+	require.Equal(t, 0, state.Read)
+	require.ElementsMatch(t, []int{0, 1}, state.Acked)
+	require.Equal(t, 2, state.Shards["/gone"].Failed)
+	router.table.Store(table)
+	code, state = load("second", "application/geo+json", collection)
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, state.Done)
+	require.Empty(t, state.Acked)
+	// the features the first try stored aren't sent again
+	require.Equal(t, shardImport{Inserted: 2}, *state.Shards["/ia"])
+	require.Equal(t, shardImport{Inserted: 2}, *state.Shards["/ib"])
+	require.Equal(t, before+2, count("ia"))
+	// and features without an id get the same one on every try
+	started := state.Started
+	require.Equal(t, sequenceID("second", started, 1), sequenceID("second", started, 1))
+	require.Equal(t, http.StatusOK, serve(t, mux, "GET", "/ia/feature/"+sequenceID("second", started, 1), nil).Code)
+	require.Equal(t, http.StatusOK, serve(t, mux, "GET", "/ib/feature/"+sequenceID("second", started, 3), nil).Code)
+	parsed, err := uuid.Parse(sequenceID("second", started, 3))
+	require.NoError(t, err)
+	require.Equal(t, uuid.Version(7), parsed.Version())
+	require.Less(t, sequenceID("second", started, 9), sequenceID("second", started, 10))
+
+	// the features read before are skipped
+	router.importMu.Lock()
+	router.imports["third"] = &importState{ID: "third", Read: 2, Shards: map[string]*shardImport{}, Errors: []string{}}
+	router.importMu.Unlock()
+	code, state = load("third", "application/x-ndjson", []string{pin("s0", -10), pin("s1", -10), pin("s2", -10)})
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 3, state.Read)
+	require.Equal(t, shardImport{Inserted: 1}, *state.Shards["/ia"])
+	require.Equal(t, http.StatusNotFound, serve(t, mux, "GET", "/ia/feature/s0", nil).Code)
+}
+
+func TestLoadStats(t *testing.T) {
+	mux := http.NewServeMux()
+	_, router := startCluster(t, mux, []string{"la", "lb"}, nil, nil,
+		WithTablePath(filepath.Join(t.TempDir(), "routing.json")),
+		WithSplitPolicy(SplitPolicy{MaxRate: 0.01, MaxFeatures: 5}))
+
+	// the west sector takes every write
+	for i := range 10 {
+		feature := geojson.NewFeature(orb.Point{-175 + float64(i)*17, 10})
+		feature.ID = "h" + strconv.Itoa(i)
+		require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/insert", encodePoint(feature)).Code)
+	}
+	require.Equal(t, http.StatusOK, serve(t, mux, "GET", "/select?rect=-170,0,-160,20", nil).Code)
+
+	var stats struct {
+		Sectors []struct {
+			Bound  [4]float64 `json:"bound"`
+			Shard  string     `json:"shard"`
+			Reads  float64    `json:"reads"`
+			Writes float64    `json:"writes"`
+			Bytes  float64    `json:"bytes"`
+		} `json:"sectors"`
+		Shards map[string]map[string]float64 `json:"shards"`
+	}
+	rec := serve(t, mux, "GET", "/stats", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	require.Len(t, stats.Sectors, 2)
+	hot := stats.Sectors[0]
+	require.Equal(t, [4]float64{-180, -90, 0, 90}, hot.Bound)
+	require.Equal(t, "/la", hot.Shard)
+	require.Greater(t, hot.Writes, 0.0)
+	require.Greater(t, hot.Reads, 0.0)
+	require.Greater(t, hot.Bytes, 0.0)
+	require.Zero(t, stats.Sectors[1].Writes)
+	require.Equal(t, hot.Writes, stats.Shards["/la"]["writes"])
+
+	// the Storage counts its own cells
+	var storageStats struct {
+		Features int        `json:"features"`
+		Bytes    int64      `json:"bytes"`
+		Cells    []cellLoad `json:"cells"`
+	}
+	rec = serve(t, mux, "GET", "/la/stats", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &storageStats))
+	require.Equal(t, 10, storageStats.Features)
+	require.Greater(t, storageStats.Bytes, int64(0))
+	written := 0
+	for _, cell := range storageStats.Cells {
+		if cell.Writes > 0 {
+			written++
+		}
+	}
+	require.Equal(t, 10, written)
+	rec = serve(t, mux, "GET", "/la/stats?rect=-159,10,-158,11", nil)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &storageStats))
+	require.Equal(t, 1, storageStats.Features)
+	// the select counted in the cells with features only, not the one below
+	require.Len(t, storageStats.Cells, 1)
+	require.Equal(t, [4]float64{-160, 10, -155, 15}, storageStats.Cells[0].Bound)
+	require.Greater(t, storageStats.Cells[0].Reads, 0.0)
+	require.Greater(t, storageStats.Cells[0].Writes, 0.0)
+	require.Equal(t, http.StatusBadRequest, serve(t, mux, "GET", "/la/stats?rect=1,2", nil).Code)
+
+	// a select of the whole map is one read shared by the cells it found
+	reads := func() float64 {
+		rec := serve(t, mux, "GET", "/la/stats", nil)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &storageStats))
+		total := 0.0
+		for _, cell := range storageStats.Cells {
+			total += cell.Reads
+		}
+		return total
+	}
+	before := reads()
+	require.Equal(t, http.StatusOK, serve(t, mux, "GET", "/la/select?rect=-180,-90,180,90", nil).Code)
+	require.InDelta(t, before+math.Ln2/loadHalfLife.Seconds(), reads(), 1e-4)
+	require.Len(t, storageStats.Cells, 10)
+
+	// the hot sector is proposed for a split
+	var evaluated struct {
+		Proposals []splitProposal `json:"proposals"`
+		Split     *splitProposal  `json:"split"`
+	}
+	rec = serve(t, mux, "POST", "/rebalance/evaluate", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &evaluated))
+	require.Len(t, evaluated.Proposals, 1)
+	require.Equal(t, [4]float64{-180, -90, 0, 90}, evaluated.Proposals[0].Sector)
+	require.Equal(t, "/lb", evaluated.Proposals[0].To)
+	require.Equal(t, 10, evaluated.Proposals[0].Features)
+	require.Contains(t, evaluated.Proposals[0].Reason, "10 features over 5")
+	require.Nil(t, evaluated.Split)
+	require.Len(t, router.routes().sectors, 2)
+
+	// and split, when the policy is automatic: the west half had the select
+	// and more writes, so it moves
+	router.policy.Auto = true
+	rec = serve(t, mux, "POST", "/rebalance/evaluate", nil)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &evaluated))
+	require.NotNil(t, evaluated.Split)
+	require.Len(t, router.routes().sectors, 3)
+	for i := range 10 {
+		west := -175+float64(i)*17 <= -90
+		id := "h" + strconv.Itoa(i)
+		require.Equal(t, !west, serve(t, mux, "GET", "/la/feature/"+id, nil).Code == http.StatusOK, id)
+		require.Equal(t, west, serve(t, mux, "GET", "/lb/feature/"+id, nil).Code == http.StatusOK, id)
+	}
+
+	// the sizes follow the writes, and a rect counts the features by center
+	size := func(url string) (int, int64) {
+		rec := serve(t, mux, "GET", url, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &storageStats))
+		return storageStats.Features, storageStats.Bytes
+	}
+	features, bytes := size("/lb/stats")
+	require.Equal(t, 6, features)
+	line := geojson.NewFeature(orb.LineString{{-178, 10}, {-100, 10}})
+	line.ID = "h0"
+	line.Properties["note"] = "longer"
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/replace", encodePoint(line)).Code)
+	features, grown := size("/lb/stats")
+	require.Equal(t, 6, features)
+	require.Greater(t, grown, bytes)
+	features, _ = size("/lb/stats?rect=-180,0,-140,20")
+	require.Equal(t, 2, features)
+	features, _ = size("/lb/stats?rect=-142,0,-138,20")
+	require.Equal(t, 2, features)
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/delete", []byte(`{"id":"h0"}`)).Code)
+	features, shrunk := size("/lb/stats")
+	require.Equal(t, 5, features)
+	require.Less(t, shrunk, bytes)
+
+	// a batch counts the bytes of each feature, not their average
+	var ring orb.Ring
+	for i := range 200 {
+		angle := 2 * math.Pi * float64(i) / 200
+		ring = append(ring, orb.Point{-120 + math.Cos(angle), 50 + math.Sin(angle)})
+	}
+	ring = append(ring, ring[0])
+	batch := geojson.NewFeatureCollection()
+	batch.Append(geojson.NewFeature(orb.Polygon{ring}))
+	batch.Append(geojson.NewFeature(orb.Point{-100, 50}))
+	body, err := batch.MarshalJSON()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, serve(t, mux, "POST", "/lb/batch", body).Code)
+	cellBytes := func(rect string) float64 {
+		rec := serve(t, mux, "GET", "/lb/stats?rect="+rect, nil)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &storageStats))
+		require.Len(t, storageStats.Cells, 1)
+		return storageStats.Cells[0].Bytes
+	}
+	require.Greater(t, cellBytes("-121,49,-119,51"), 10*cellBytes("-101,49,-99,51"))
 }
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	// routingFeature is the id of the feature a metadata Storage keeps the
+	// routing table in, so it is logged, checkpointed and replicated like
+	// any other write. It is left out of the spatial index and clients of
+	// the metadata Storage can't use the id, so the table is only reached
+	// through /routing.
+	routingFeature = "routing-table"
+	// routingVersionHeader carries the version of the routing table a
+	// request was routed with, and the one to refresh to when it is stale.
+	routingVersionHeader = "X-Routing-Version"
+	// watchWait is how long a watch waits for a new routing table before it
+	// asks again.
+	watchWait = 5 * time.Second
+	// maxWatchWait bounds the wait of a watch request.
+	maxWatchWait = time.Minute
+)
+
+var (
+	errTableVersion = errors.New("the routing table was changed meanwhile")
+	errStaleRouting = errors.New("the feature is not on this shard, refresh the routing table")
+)
+
+// versionedTable is the cluster metadata: the shards with their replicas
+// and leader, the sectors of the map, and the version the metadata Storage
+// gave it. Versions start at 1 and grow with every change.
+type versionedTable struct {
+	Version uint64          `json:"version"`
+	Table   json.RawMessage `json:"table"`
+}
+
+// WithMetadataStore makes the Storage keep the versioned routing table of
+// the cluster at /{name}/routing, for Routers and Storages to watch. It is
+// best run as a replica set of its own.
+func WithMetadataStore() StorageOption {
+	return func(s *Storage) {
+		s.metadata = true
+		s.eng.keepTable()
+	}
+}
+
+// keepTable makes the engine keep the routing table under routingFeature,
+// left out of the spatial index and the sizes of the cells. The table may
+// have been loaded already.
+func (e *Engine) keepTable() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if rec, exists := e.primary[routingFeature]; exists && !e.table {
+		min, max := bound(rec.feature)
+		e.spatial.Delete(min, max, routingFeature)
+		e.count(rec, -1)
+	}
+	e.table = true
+}
+
+// keepsTable reports whether id is the routing table of a metadata
+// Storage. The caller holds e.mu.
+func (e *Engine) keepsTable(id any) bool {
+	return e.table && id == routingFeature
+}
+
+// WithRoutingWatch makes the Storage watch the routing table kept by the
+// metadata Storage at addr, such as http://127.0.0.1:8080/meta. Writes
+// routed with an older table for a feature of another shard are refused
+// with 421 and the version to refresh to. Shard addresses must end with
+// the names of their Storages.
+func WithRoutingWatch(addr string) StorageOption {
+	return func(s *Storage) {
+		s.routing = &tableWatch{addr: addr, client: &http.Client{}}
+	}
+}
+
+// routingTable returns the routing table kept by the Storage, and the
+// channel closed on its next change.
+func (s *Storage) routingTable() (*versionedTable, <-chan struct{}) {
+	s.eng.mu.Lock()
+	defer s.eng.mu.Unlock()
+	rec, ok := s.eng.primary[routingFeature]
+	if !ok {
+		return nil, s.eng.progress
+	}
+	table, _ := rec.feature.Properties["table"].(string)
+	return &versionedTable{Version: rec.version, Table: json.RawMessage(table)}, s.eng.progress
+}
+
+// routingHandler answers with the routing table and its version. With the
+// after parameter it waits up to the wait duration for a version newer
+// than after, and answers 304 if none comes.
+func (s *Storage) routingHandler(w http.ResponseWriter, r *http.Request) {
+	var after uint64
+	if get := r.URL.Query().Get("after"); get != "" {
+		var err error
+		if after, err = strconv.ParseUint(get, 10, 64); err != nil {
+			http.Error(w, "invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	var wait time.Duration
+	if get := r.URL.Query().Get("wait"); get != "" {
+		var err error
+		if wait, err = time.ParseDuration(get); err != nil || wait < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+	}
+	deadline := time.NewTimer(min(wait, maxWatchWait))
+	defer deadline.Stop()
+	for {
+		table, wake := s.routingTable()
+		if table != nil && table.Version > after {
+			writeJSON(w, table)
+			return
+		}
+		select {
+		case <-wake:
+			continue
+		case <-deadline.C:
+		case <-r.Context().Done():
+		case <-s.ctx.Done():
+		}
+		if table == nil && after == 0 {
+			http.Error(w, "no routing table yet", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+}
+
+// publishHandler stores a new routing table if the version in the request
+// is still the current one, 0 for the first table, and answers with the
+// version of the new one. Otherwise it answers 409.
+func (s *Storage) publishHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("publish routing method")
+	var data versionedTable
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	var table RoutingTable
+	if err := json.Unmarshal(data.Table, &table); err != nil {
+		http.Error(w, "invalid routing table: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	compact, err := json.Marshal(&table)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	current, _ := s.routingTable()
+	action := "insert"
+	if current != nil {
+		action = "replace"
+	}
+	if (current == nil && data.Version != 0) || (current != nil && current.Version != data.Version) {
+		http.Error(w, errTableVersion.Error(), http.StatusConflict)
+		return
+	}
+	feature := geojson.NewFeature(orb.Point{0, 0})
+	feature.ID = routingFeature
+	feature.Properties["table"] = string(compact)
+	txn := &Transaction{Action: action, Name: s.name, LSN: s.eng.lsn.Load(), Feature: feature}
+	if res := s.write(w, r, txn); res.err != nil {
+		writeError(w, res.err)
+		return
+	}
+	writeJSON(w, map[string]uint64{"version": txn.Version})
+}
+
+// tableWatch keeps the latest routing table of a metadata Storage.
+type tableWatch struct {
+	addr   string
+	client *http.Client
+	// onChange is called with every newer table
+	onChange func(*RoutingTable)
+
+	mu      sync.Mutex
+	version uint64
+	table   *RoutingTable
+}
+
+// current returns the latest table and its version, 0 before the first.
+func (t *tableWatch) current() (uint64, *RoutingTable) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.version, t.table
+}
+
+// set keeps the table if it is newer than the one held.
+func (t *tableWatch) set(version uint64, table *RoutingTable) {
+	t.mu.Lock()
+	if version <= t.version {
+		t.mu.Unlock()
+		return
+	}
+	t.version, t.table = version, table
+	t.mu.Unlock()
+	slog.Info("routing table changed", slog.String("metadata", t.addr), slog.Uint64("version", version))
+	if t.onChange != nil {
+		t.onChange(table)
+	}
+}
+
+// fetch asks the metadata Storage for a table newer than the one held,
+// waiting up to wait for one.
+func (t *tableWatch) fetch(ctx context.Context, wait time.Duration) error {
+	version, _ := t.current()
+	url := fmt.Sprintf("%s/routing?after=%d&wait=%s", strings.TrimSuffix(t.addr, "/"), version, wait)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified, http.StatusNotFound:
+		return nil
+	default:
+		return &statusError{code: resp.StatusCode, body: strings.TrimSpace(string(data))}
+	}
+	var got versionedTable
+	if err := json.Unmarshal(data, &got); err != nil {
+		return err
+	}
+	table := &RoutingTable{}
+	if err := json.Unmarshal(got.Table, table); err != nil {
+		return err
+	}
+	t.set(got.Version, table)
+	return nil
+}
+
+// watch fetches every new table until ctx is done, backing off while the
+// metadata Storage is unreachable.
+func (t *tableWatch) watch(ctx context.Context) {
+	backoff := retryBackoff
+	for ctx.Err() == nil {
+		if err := t.fetch(ctx, watchWait); err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("watching routing table", slog.String("metadata", t.addr), slog.String("error", err.Error()))
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			backoff = min(backoff*2, watchWait)
+			continue
+		}
+		backoff = retryBackoff
+	}
+}
+
+// publish stores next as the version after the one held. It fails with
+// errTableVersion, and fetches the newer table, if another one was
+// published meanwhile.
+func (t *tableWatch) publish(ctx context.Context, next *RoutingTable) error {
+	version, _ := t.current()
+	table, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(versionedTable{Version: version, Table: table})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", strings.TrimSuffix(t.addr, "/")+"/routing", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		t.fetch(ctx, 0)
+		return errTableVersion
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{code: resp.StatusCode, body: strings.TrimSpace(string(data))}
+	}
+	var published struct {
+		Version uint64 `json:"version"`
+	}
+	if err := json.Unmarshal(data, &published); err != nil {
+		return err
+	}
+	t.set(published.Version, next)
+	return nil
+}
+
+// routedVersion returns the version of the routing table a request was
+// routed with, from the header of a proxied request or the query of a
+// redirected one, 0 if unknown.
+func routedVersion(r *http.Request) uint64 {
+	get := r.Header.Get(routingVersionHeader)
+	if get == "" {
+		get = r.URL.Query().Get("routing")
+	}
+	version, _ := strconv.ParseUint(get, 10, 64)
+	return version
+}
+
+// owns checks a write routed with an older routing table than the
+// Storage's: if the newer table puts the feature on another shard, it
+// answers 421 with the version the Router should refresh to.
+func (s *Storage) owns(w http.ResponseWriter, r *http.Request, id string, feature *geojson.Feature) bool {
+	if version := s.misrouted(r, id, feature); version > 0 {
+		refuseMisrouted(w, version)
+		return false
+	}
+	return true
+}
+
+// ownsStored is owns for a write to a stored feature, which is where the
+// feature is now. Writes to features the Storage doesn't have go on, to be
+// answered 404.
+func (s *Storage) ownsStored(w http.ResponseWriter, r *http.Request, id string) bool {
+	if s.routing == nil {
+		return true
+	}
+	found, _ := s.eng.get([]string{id})
+	if len(found) == 0 {
+		return true
+	}
+	return s.owns(w, r, id, found[0].feature)
+}
+
+// misrouted returns the version of the Storage's routing table if the
+// request was routed with an older one and the feature is on another shard
+// now, 0 otherwise.
+func (s *Storage) misrouted(r *http.Request, id string, feature *geojson.Feature) uint64 {
+	if s.routing == nil {
+		return 0
+	}
+	routed := routedVersion(r)
+	version, table := s.routing.current()
+	if routed == 0 || table == nil || routed >= version {
+		return 0
+	}
+	shard, err := table.Locate(id, feature.Geometry.Bound())
+	if err != nil || s.member(shard) {
+		return 0
+	}
+	return version
+}
+
+func refuseMisrouted(w http.ResponseWriter, version uint64) {
+	w.Header().Set(routingVersionHeader, strconv.FormatUint(version, 10))
+	http.Error(w, errStaleRouting.Error(), http.StatusMisdirectedRequest)
+}
+
+// member reports whether the Storage is the leader or a replica of shard.
+func (s *Storage) member(shard *Shard) bool {
+	if path.Base(shard.LeaderAddr) == s.name {
+		return true
+	}
+	for _, addr := range shard.Replicas {
+		if path.Base(addr) == s.name {
+			return true
+		}
+	}
+	return false
+}
+
+// WithMetadata makes the Router take its routing table from the metadata
+// Storage at addr, such as http://127.0.0.1:8080/meta, and watch it for
+// changes made by other Routers. The Router publishes its own table if
+// there is none yet, and the tables its rebalances flip to.
+func WithMetadata(addr string) RouterOption {
+	return func(r *Router) {
+		r.meta = &tableWatch{addr: addr}
+	}
+}
+
+// refresh fetches the latest routing table at once, when a Storage said the
+// Router's is stale.
+func (r *Router) refresh(ctx context.Context) {
+	if r.meta == nil {
+		return
+	}
+	if err := r.meta.fetch(ctx, 0); err != nil {
+		slog.Error("refreshing routing table", slog.String("error", err.Error()))
+	}
+}
+
+// routedWith returns the version of the routing table in use, "" without a
+// metadata Storage.
+func (r *Router) routedWith() string {
+	if r.meta == nil {
+		return ""
+	}
+	version, _ := r.meta.current()
+	if version == 0 {
+		return ""
+	}
+	return strconv.FormatUint(version, 10)
+}
+
+// watchMetadata takes the routing table from the metadata Storage, or
+// publishes the Router's own when there is none, and watches it.
+func (r *Router) watchMetadata() {
+	if r.meta == nil {
+		return
+	}
+	if err := r.meta.fetch(r.ctx, 0); err != nil {
+		slog.Error("fetching routing table", slog.String("error", err.Error()))
+	} else if version, _ := r.meta.current(); version == 0 {
+		if err := r.meta.publish(r.ctx, r.routes()); err != nil {
+			slog.Error("publishing routing table", slog.String("error", err.Error()))
+		}
+	}
+	go r.meta.watch(r.ctx)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// The phases of a move. A prepared move has written the feature to the new
+// shard, a committed one has to evict it from the old shard.
+const (
+	movePrepare = "prepare"
+	moveCommit  = "commit"
+)
+
+var errMoving = errors.New("the feature is moving to another shard, retry")
+
+// moveIntent records a feature moving between shards because a replace put
+// it in a sector of another shard. Until the commit, reads see the copy on
+// the old shard; after it, the copy on the new one. A Router that crashes
+// rolls prepared moves back and committed ones forward when it starts.
+type moveIntent struct {
+	Phase string `json:"phase"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// idLock serializes the writes of the Router to a feature.
+type idLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockID keeps other writes to the feature out while its write is routed,
+// so that a move doesn't lose a write made to the old copy meanwhile.
+// Clients redirected to a Storage write after the lock is given back.
+func (r *Router) lockID(id string) (unlock func()) {
+	r.movesMu.Lock()
+	l, ok := r.idLocks[id]
+	if !ok {
+		l = &idLock{}
+		r.idLocks[id] = l
+	}
+	l.refs++
+	r.movesMu.Unlock()
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		r.movesMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(r.idLocks, id)
+		}
+		r.movesMu.Unlock()
+	}
+}
+
+func (r *Router) movesPath() string {
+	return r.tablePath + ".moves"
+}
+
+// saveMoves writes the moves in progress next to the routing table. The
+// caller holds movesMu.
+func (r *Router) saveMoves() error {
+	if r.tablePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(r.moves)
+	if err != nil {
+		return err
+	}
+	tmp := r.movesPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.movesPath())
+}
+
+// intent returns the move of the feature in progress.
+func (r *Router) intent(id string) (moveIntent, bool) {
+	r.movesMu.Lock()
+	defer r.movesMu.Unlock()
+	m, ok := r.moves[id]
+	return m, ok
+}
+
+// setIntent records the move of the feature in its phase, or drops it.
+func (r *Router) setIntent(id string, m *moveIntent) error {
+	r.movesMu.Lock()
+	defer r.movesMu.Unlock()
+	if m == nil {
+		delete(r.moves, id)
+	} else {
+		r.moves[id] = *m
+	}
+	return r.saveMoves()
+}
+
+// hidden reports whether reads skip the copy of a moving feature on the
+// shard with the leader address.
+func (r *Router) hidden(id, addr string) bool {
+	m, ok := r.intent(id)
+	if !ok {
+		return false
+	}
+	if m.Phase == moveCommit {
+		return addr == m.From
+	}
+	return addr == m.To
+}
+
+// movesPending reports whether features are moving, and reads have to hide
+// one of their copies.
+func (r *Router) movesPending() bool {
+	r.movesMu.Lock()
+	defer r.movesMu.Unlock()
+	return len(r.moves) > 0
+}
+
+// has reports whether the shard has the live feature.
+func (r *Router) has(ctx context.Context, shard *Shard, id string) bool {
+	resp, err := r.fetch(ctx, "GET", shard.LeaderAddr+"/feature/"+url.PathEscape(id), nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// holder returns the shard with the feature a replace sends to another
+// shard, nil when it stays on the same one.
+func (r *Router) holder(ctx context.Context, id string, to *Shard) *Shard {
+	table := r.routes()
+	if len(table.Shards()) == 1 || table.Owner(id) != nil || r.has(ctx, to, id) {
+		return nil
+	}
+	for _, shard := range table.Shards() {
+		if shard != to && r.has(ctx, shard, id) {
+			return shard
+		}
+	}
+	return nil
+}
+
+// move replaces a feature by writing it to its new shard and evicting it
+// from the old one. The intent is saved before each step, so a crash leaves
+// the feature on one of the shards, never on both nor on none.
+func (r *Router) move(w http.ResponseWriter, req *http.Request, id string, from, to *Shard, feature *geojson.Feature) {
+	ctx := context.WithoutCancel(req.Context())
+	m := &moveIntent{Phase: movePrepare, From: from.LeaderAddr, To: to.LeaderAddr}
+	if err := r.setIntent(id, m); err != nil {
+		writeError(w, err)
+		return
+	}
+	slog.Info("moving feature", slog.String("id", id), slog.String("from", m.From), slog.String("to", m.To))
+	if err := r.upsert(ctx, m.To, feature); err != nil {
+		r.settle(id, *m)
+		http.Error(w, "can't move the feature: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	m.Phase = moveCommit
+	if err := r.setIntent(id, m); err != nil {
+		r.settle(id, moveIntent{Phase: movePrepare, From: m.From, To: m.To})
+		writeError(w, err)
+		return
+	}
+	r.settle(id, *m)
+	w.WriteHeader(http.StatusOK)
+}
+
+// settle ends a move: a prepared one is rolled back from the new shard, a
+// committed one evicted from the old shard. Failures are retried in the
+// background until the Router stops, and writes to the feature are refused
+// meanwhile.
+func (r *Router) settle(id string, m moveIntent) {
+	if err := r.finish(id, m); err == nil {
+		return
+	}
+	go func() {
+		backoff := retryBackoff
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-r.ctx.Done():
+				return
+			}
+			if err := r.finish(id, m); err == nil {
+				return
+			}
+			backoff = min(backoff*2, watchWait)
+		}
+	}()
+}
+
+func (r *Router) finish(id string, m moveIntent) error {
+	addr := m.To
+	if m.Phase == moveCommit {
+		addr = m.From
+	}
+	body, _ := json.Marshal(map[string][]string{"ids": {id}})
+	if _, err := r.post(r.ctx, addr+"/evict", body); err != nil {
+		slog.Error("settling move", slog.String("id", id), slog.String("phase", m.Phase), slog.String("error", err.Error()))
+		return err
+	}
+	return r.setIntent(id, nil)
+}
+
+// resumeMoves settles the moves saved by a Router that was stopped.
+func (r *Router) resumeMoves() {
+	if r.tablePath == "" {
+		return
+	}
+	data, err := os.ReadFile(r.movesPath())
+	if err != nil {
+		return
+	}
+	moves := map[string]moveIntent{}
+	if err := json.Unmarshal(data, &moves); err != nil {
+		slog.Error("moves", slog.String("error", err.Error()))
+		return
+	}
+	r.movesMu.Lock()
+	for id, m := range moves {
+		r.moves[id] = m
+	}
+	r.movesMu.Unlock()
+	for id, m := range moves {
+		slog.Info("resuming move", slog.String("id", id), slog.String("phase", m.Phase))
+		r.settle(id, m)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+var (
+	errInvalidPatch  = errors.New("invalid patch")
+	errPatchConflict = errors.New("patch test failed")
+)
+
+// Patch is a partial update of a feature: either an RFC 7396 merge patch or
+// an RFC 6902 JSON Patch, told apart by the media type.
+type Patch struct {
+	Type string          `json:"type"`
+	Doc  json.RawMessage `json:"doc"`
+}
+
+// applyPatch returns a patched copy of feature. The patch may not change the
+// feature ID or leave it without a geometry. When the geometry is not
+// touched the original geometry is kept, so that the spatial index does not
+// have to be updated.
+func applyPatch(feature *geojson.Feature, patch *Patch) (*geojson.Feature, error) {
+	doc, err := feature.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	switch patch.Type {
+	case mergePatchType:
+		out, err = jsonpatch.MergePatch(doc, patch.Doc)
+	case jsonPatchType:
+		var ops jsonpatch.Patch
+		if ops, err = jsonpatch.DecodePatch(patch.Doc); err == nil {
+			out, err = ops.Apply(doc)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported type %q", errInvalidPatch, patch.Type)
+	}
+	if errors.Is(err, jsonpatch.ErrTestFailed) {
+		return nil, fmt.Errorf("%w: %v", errPatchConflict, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidPatch, err)
+	}
+
+	result, err := geojson.UnmarshalFeature(out)
+	if err != nil || result.Geometry == nil {
+		return nil, fmt.Errorf("%w: result is not a feature with geometry", errInvalidPatch)
+	}
+	if id, err := parseID(result.ID); err != nil || id != feature.ID {
+		return nil, fmt.Errorf("%w: feature id can't be changed", errInvalidPatch)
+	}
+	result.ID = feature.ID
+
+	before, _ := geojson.NewGeometry(feature.Geometry).MarshalJSON()
+	after, _ := geojson.NewGeometry(result.Geometry).MarshalJSON()
+	if bytes.Equal(before, after) {
+		result.Geometry = feature.Geometry
+	}
+	return result, nil
+}
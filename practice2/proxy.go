@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// requestIDHeader carries the id of a request through the Router to the
+	// Storages and back to the client.
+	requestIDHeader = "X-Request-ID"
+	// defaultProxyTimeout bounds every request from the Router to a Storage.
+	defaultProxyTimeout = 10 * time.Second
+	// maxIdlePerShard is how many idle connections are kept to each host.
+	maxIdlePerShard = 16
+	// retryBackoff is the wait before the first retry, doubled for each next.
+	retryBackoff = 50 * time.Millisecond
+)
+
+type requestIDKey struct{}
+
+// hopHeaders are the headers of a connection, not passed through a proxy.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// WithProxy makes the Router proxy requests to the Storages instead of
+// redirecting the clients to them, so Storages may run in other processes
+// or hosts and clients only ever see the Router. Every request to a Storage
+// times out after timeout, and idempotent reads are retried up to retries
+// times on network errors and 502, 503 and 504.
+func WithProxy(timeout time.Duration, retries int) RouterOption {
+	return func(r *Router) {
+		r.proxy = true
+		if timeout > 0 {
+			r.timeout = timeout
+		}
+		r.retries = retries
+	}
+}
+
+// handle registers a Router handler that gives every request an id: the
+// client's X-Request-ID or a new one. It is answered in the response and
+// passed on to the Storages.
+func (r *Router) handle(pattern string, handler http.HandlerFunc) {
+	r.mux.HandleFunc(pattern, func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if id == "" {
+			id = uuid.NewString()
+			req.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		handler(w, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+// rewind makes the request body readable again after the Router read it.
+func rewind(req *http.Request, body []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+}
+
+// forward sends the request to the same path and query on addr, or a
+// healthy replica while addr is out of rotation: a 307 redirect, or through
+// the proxy.
+func (r *Router) forward(w http.ResponseWriter, req *http.Request, addr string) {
+	if !r.proxy {
+		addr = r.live(addr)
+		target := *req.URL
+		if version := r.routedWith(); version != "" {
+			// the client doesn't keep headers across the redirect
+			query := target.Query()
+			query.Set("routing", version)
+			target.RawQuery = query.Encode()
+		}
+		http.Redirect(w, req, strings.TrimSuffix(addr, "/")+target.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+	r.proxyTo(w, req, addr)
+}
+
+// idempotent reports whether a request may be sent again.
+func idempotent(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+func retryable(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// proxyTo makes the request to addr, or a healthy replica while it is out
+// of rotation, and copies the response back. Redirects between Storages,
+// such as to the leader, are followed by the proxy.
+func (r *Router) proxyTo(w http.ResponseWriter, req *http.Request, addr string) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	var url string
+	attempts := 1
+	if idempotent(req.Method) {
+		attempts += r.retries
+	}
+
+	var resp *http.Response
+	for attempt := range attempts {
+		if attempt > 0 {
+			select {
+			case <-time.After(retryBackoff << (attempt - 1)):
+			case <-req.Context().Done():
+				return
+			}
+			slog.Info("retrying proxied read", slog.String("url", url), slog.String("request", req.Header.Get(requestIDHeader)), slog.Int("attempt", attempt))
+		}
+		// a retry goes to a replica once the node is out of rotation
+		url = strings.TrimSuffix(r.live(addr), "/") + req.URL.RequestURI()
+		var out *http.Request
+		out, err = http.NewRequestWithContext(req.Context(), req.Method, url, bytes.NewReader(body))
+		if err != nil {
+			break
+		}
+		out.Header = req.Header.Clone()
+		for _, h := range hopHeaders {
+			out.Header.Del(h)
+		}
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			out.Header.Add("X-Forwarded-For", host)
+		}
+		if version := r.routedWith(); version != "" {
+			out.Header.Set(routingVersionHeader, version)
+		}
+		resp, err = r.proxyClient.Do(out)
+		if attempt == attempts-1 || req.Context().Err() != nil {
+			break
+		}
+		if err != nil {
+			continue
+		}
+		if !retryable(resp.StatusCode) {
+			break
+		}
+		resp.Body.Close()
+	}
+	if err != nil {
+		slog.Error("proxy", slog.String("url", url), slog.String("request", req.Header.Get(requestIDHeader)), slog.String("error", err.Error()))
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			http.Error(w, "storage timed out", http.StatusGatewayTimeout)
+			return
+		}
+		http.Error(w, "storage unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusMisdirectedRequest {
+		// the client retries with the table the Storage knows of
+		r.refresh(req.Context())
+	}
+
+	for h, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(h, v)
+		}
+	}
+	for _, h := range hopHeaders {
+		w.Header().Del(h)
+	}
+	w.Header().Set(requestIDHeader, req.Header.Get(requestIDHeader))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
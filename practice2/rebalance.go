@@ -0,0 +1,815 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	// maxTailRounds bounds how many times the changes made during a copy are
+	// copied before the writes are fenced for the last ones.
+	maxTailRounds = 5
+	// quietTail is how few changes are left for the fence to be brief.
+	quietTail = 10
+	// holdLease is how long the hold of a migration on the old shard lasts
+	// after its last request, should the Router running it go away.
+	holdLease = time.Minute
+)
+
+// The phases of a migration. It is saved after each of them, and resumed
+// from the last one after a crash.
+const (
+	phaseCopy    = "copy"
+	phaseTail    = "tail"
+	phaseCleanup = "cleanup"
+	phaseDone    = "done"
+)
+
+var (
+	errMigrating = errors.New("a migration is in progress")
+	errFenced    = errors.New("the sector is moving to another shard, retry")
+)
+
+// migrationHold is what a migration needs of the old shard: the history
+// after lsn kept whatever the retention, so its changes can be tailed, and
+// during the cutover the writes to its sector refused.
+type migrationHold struct {
+	lsn   uint64
+	fence *orb.Bound
+	until time.Time
+}
+
+// hold sets or renews the hold of a migration. The caller holds e.mu.
+func (e *Engine) hold(id string) *migrationHold {
+	h, ok := e.holds[id]
+	if !ok {
+		h = &migrationHold{lsn: e.lsn.Load()}
+		e.holds[id] = h
+	}
+	h.until = time.Now().Add(holdLease)
+	return h
+}
+
+// held returns the oldest LSN the history is held from, and false without
+// holds. Expired holds are dropped. The caller holds e.mu.
+func (e *Engine) held(now time.Time) (uint64, bool) {
+	var floor uint64
+	held := false
+	for id, h := range e.holds {
+		if now.After(h.until) {
+			delete(e.holds, id)
+			continue
+		}
+		if !held || h.lsn < floor {
+			floor, held = h.lsn, true
+		}
+	}
+	return floor, held
+}
+
+// moving reports whether a write puts a feature in a fenced sector or
+// changes one there, by the centers of the geometries like the routing
+// table. The caller holds e.mu.
+func (e *Engine) moving(txn *Transaction) bool {
+	if len(e.holds) == 0 || txn.Action == "evict" || txn.Action == "purge" {
+		return false
+	}
+	var centers []orb.Point
+	if txn.Feature.Geometry != nil {
+		centers = append(centers, txn.Feature.Geometry.Bound().Center())
+	}
+	if rec, exists := e.primary[txn.Feature.ID.(string)]; exists {
+		centers = append(centers, rec.feature.Geometry.Bound().Center())
+	}
+	now := time.Now()
+	for _, h := range e.holds {
+		if h.fence == nil || now.After(h.until) {
+			continue
+		}
+		for _, center := range centers {
+			if h.fence.Contains(center) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shardExport is a page of the features of a Storage for a migration: all
+// of them in a rect, or those changed after a consistency token, live ones
+// with their feature and removed ones by id.
+type shardExport struct {
+	Token    string             `json:"token"`
+	Features []*geojson.Feature `json:"features"`
+	Removed  []string           `json:"removed"`
+}
+
+// export returns the live features intersecting rect, the whole map if nil,
+// or, with a token, the features changed after it. With a hold, the history
+// is kept from the export on for the changes to be asked for next.
+func (e *Engine) export(rect *orb.Bound, after *consistencyToken, hold string) (*shardExport, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	lsn := e.lsn.Load()
+	out := &shardExport{
+		Token:    consistencyToken{name: e.name, lsn: lsn}.String(),
+		Features: []*geojson.Feature{},
+		Removed:  []string{},
+	}
+	if hold != "" {
+		h := e.hold(hold)
+		h.lsn = lsn
+		if after != nil && after.name == e.name {
+			// until the Router saved the new token
+			h.lsn = min(lsn, after.lsn)
+		}
+	}
+	if after == nil {
+		collect := func(min, max [2]float64, data interface{}) bool {
+			out.Features = append(out.Features, e.primary[data.(string)].feature)
+			return true
+		}
+		if rect == nil {
+			e.spatial.Scan(collect)
+		} else {
+			e.spatial.Search(rect.Min, rect.Max, collect)
+		}
+		sortByID(out.Features)
+		return out, nil
+	}
+	// the history only has the changes from the horizon on
+	if after.name != e.name || after.lsn < e.horizonLSN || after.lsn > lsn {
+		return nil, errHistoryGone
+	}
+	var ids []string
+	for _, txn := range e.history {
+		id := txn.Feature.ID.(string)
+		if txn.Name == e.name && txn.LSN > after.lsn && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		if rec, exists := e.primary[id]; exists {
+			out.Features = append(out.Features, rec.feature)
+		} else {
+			out.Removed = append(out.Removed, id)
+		}
+	}
+	return out, nil
+}
+
+// exportHandler pages features out for a Router moving them to another
+// shard. The rect parameter limits a full export, the after parameter,
+// a consistency token of an earlier export, asks for the changes since.
+// Answers 410 when the history doesn't go back to the token. The hold
+// parameter, the id of the migration, keeps the history for the next
+// export, see holdHandler.
+func (s *Storage) exportHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("export method")
+	var rect *orb.Bound
+	if get := r.URL.Query().Get("rect"); get != "" {
+		bound, err := parseRect(get)
+		if err != nil {
+			http.Error(w, "invalid rect: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rect = &bound
+	}
+	var after *consistencyToken
+	if get := r.URL.Query().Get("after"); get != "" {
+		token, err := parseToken(get)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		after = token
+	}
+	out, err := s.eng.export(rect, after, r.URL.Query().Get("hold"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, out)
+}
+
+// holdHandler renews the hold of a migration and fences its sector, or
+// lifts the fence without one: writes to features with their center in the
+// sector are refused with 421 until then, for the Router to route them
+// again with the next table. Holds last holdLease after the last request.
+func (s *Storage) holdHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("hold method")
+	var data struct {
+		Fence *[4]float64 `json:"fence"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	s.eng.mu.Lock()
+	h := s.eng.hold(r.PathValue("id"))
+	h.fence = nil
+	if data.Fence != nil {
+		fence := toBound(*data.Fence)
+		h.fence = &fence
+	}
+	s.eng.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// releaseHandler drops the hold of a migration that is over.
+func (s *Storage) releaseHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("release method")
+	s.eng.mu.Lock()
+	delete(s.eng.holds, r.PathValue("id"))
+	s.eng.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// evictHandler drops features moved to another shard. Unlike a delete it
+// leaves nothing in the trash, and it is replicated like any write.
+func (s *Storage) evictHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("evict method")
+	var data struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	evicted := 0
+	for _, id := range data.IDs {
+		if _, err := s.featureID(id); err != nil {
+			writeError(w, err)
+			return
+		}
+		feature := &geojson.Feature{}
+		feature.ID = id
+		res := s.exec(&Transaction{Action: "evict", Name: s.name, LSN: s.eng.lsn.Load(), Feature: feature})
+		if errors.Is(res.err, errNotFound) {
+			continue
+		}
+		if res.err != nil {
+			writeError(w, res.err)
+			return
+		}
+		evicted++
+	}
+	writeJSON(w, map[string]int{"evicted": evicted})
+}
+
+// migration moves the features of a sector from one shard to another while
+// both serve traffic:
+//
+//   - copy: the features in the sector are copied to the new shard
+//   - tail: the changes made on the old shard in the meantime follow them,
+//     until few are left; then writes are fenced, the last changes copied
+//     and the routing table flipped to the next one
+//   - cleanup: changes that slipped to the old shard follow, and the moved
+//     features are evicted from it
+//
+// A migration is saved after every step and resumed after a crash. The old
+// shard holds its history for it until the end, and during the cutover
+// refuses the writes to the sector, see holdHandler. Deleted features of
+// the sector stay in the trash of the old shard.
+type migration struct {
+	ID     string        `json:"id,omitempty"`
+	Phase  string        `json:"phase"`
+	Sector [4]float64    `json:"sector"`
+	From   string        `json:"from"`
+	To     string        `json:"to"`
+	Token  string        `json:"token,omitempty"`
+	Moved  []string      `json:"moved"`
+	Next   *RoutingTable `json:"next"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// WithTablePath makes the Router save the routing table to path whenever a
+// rebalance changes it, and its migrations next to it, to resume them when
+// it is started again.
+func WithTablePath(path string) RouterOption {
+	return func(r *Router) {
+		r.tablePath = path
+	}
+}
+
+// fenced wraps a handler of writes: during the cutover of a migration they
+// wait until the routing table is flipped.
+func (r *Router) fenced(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !idempotent(req.Method) {
+			r.fence.RLock()
+			defer r.fence.RUnlock()
+		}
+		next(w, req)
+	}
+}
+
+func (r *Router) migrationPath() string {
+	return r.tablePath + ".migration"
+}
+
+// record keeps a copy of the migration for the status, the migration itself
+// is only touched by the goroutine running it.
+func (r *Router) record(m *migration) {
+	copied := *m
+	copied.Moved = slices.Clone(m.Moved)
+	r.migMu.Lock()
+	r.moving = &copied
+	r.migMu.Unlock()
+}
+
+// save records the state of the migration, or removes it once done.
+func (r *Router) save(m *migration) error {
+	r.record(m)
+	if r.tablePath == "" {
+		return nil
+	}
+	if m.Phase == phaseDone {
+		if err := os.Remove(r.migrationPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := r.migrationPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.migrationPath())
+}
+
+// flip makes next the routing table, saved if the Router has a path and
+// published if it has a metadata Storage. It fails if another Router
+// published a table meanwhile.
+func (r *Router) flip(next *RoutingTable) error {
+	if r.meta != nil {
+		if err := r.meta.publish(r.ctx, next); err != nil {
+			return err
+		}
+	}
+	r.table.Store(next)
+	if r.tablePath == "" {
+		return nil
+	}
+	return next.Save(r.tablePath)
+}
+
+func formatBound(b [4]float64) string {
+	return fmt.Sprintf("%g,%g,%g,%g", b[0], b[1], b[2], b[3])
+}
+
+func toBound(b [4]float64) orb.Bound {
+	return orb.Bound{Min: orb.Point{b[0], b[1]}, Max: orb.Point{b[2], b[3]}}
+}
+
+func fromBound(b orb.Bound) [4]float64 {
+	return [4]float64{b.Min.X(), b.Min.Y(), b.Max.X(), b.Max.Y()}
+}
+
+// post sends JSON to a Storage and fails on any status but 200.
+func (r *Router) post(ctx context.Context, url string, body []byte) (int, error) {
+	resp, err := r.fetch(ctx, "POST", url, body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, &statusError{code: resp.StatusCode, body: string(bytes.TrimSpace(data))}
+	}
+	return resp.StatusCode, nil
+}
+
+// export reads a page of features from a Storage, see exportHandler.
+func (r *Router) export(ctx context.Context, addr string, query url.Values) (*shardExport, error) {
+	resp, err := r.fetch(ctx, "GET", addr+"/export?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{code: resp.StatusCode, body: string(bytes.TrimSpace(data))}
+	}
+	var out shardExport
+	return &out, json.Unmarshal(data, &out)
+}
+
+// upsert writes a feature to a Storage, inserted or replacing its copy.
+func (r *Router) upsert(ctx context.Context, addr string, feature *geojson.Feature) error {
+	data, err := feature.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	code, err := r.post(ctx, addr+"/insert", data)
+	if code == http.StatusConflict {
+		_, err = r.post(ctx, addr+"/replace", data)
+	}
+	return err
+}
+
+// apply copies changes of the old shard to the new one: features the next
+// table assigns to the new shard are written there, moved features that
+// were deleted or left the sector are removed from it.
+func (r *Router) apply(ctx context.Context, m *migration, changes *shardExport) error {
+	for _, feature := range changes.Features {
+		id := feature.ID.(string)
+		owner, err := m.Next.Locate(id, feature.Geometry.Bound())
+		switch {
+		case err == nil && owner.LeaderAddr == m.To:
+			if err := r.upsert(ctx, m.To, feature); err != nil {
+				return err
+			}
+			if !slices.Contains(m.Moved, id) {
+				m.Moved = append(m.Moved, id)
+			}
+		case slices.Contains(m.Moved, id):
+			body, _ := json.Marshal(map[string][]string{"ids": {id}})
+			if _, err := r.post(ctx, m.To+"/evict", body); err != nil {
+				return err
+			}
+			m.Moved = slices.DeleteFunc(m.Moved, func(moved string) bool { return moved == id })
+		}
+	}
+	for _, id := range changes.Removed {
+		if !slices.Contains(m.Moved, id) {
+			continue
+		}
+		body, _ := json.Marshal(map[string]string{"id": id})
+		if code, err := r.post(ctx, m.To+"/delete", body); err != nil && code != http.StatusNotFound {
+			return err
+		}
+		m.Moved = slices.DeleteFunc(m.Moved, func(moved string) bool { return moved == id })
+	}
+	m.Token = changes.Token
+	return nil
+}
+
+// tail copies the changes made on the old shard since the last copy, and
+// returns how many there were. When the old shard's history doesn't reach
+// back that far, the sector is compared in full again.
+func (r *Router) tail(ctx context.Context, m *migration) (int, error) {
+	changes, err := r.export(ctx, m.From, url.Values{"after": {m.Token}, "hold": {m.ID}})
+	var status *statusError
+	if errors.As(err, &status) && status.code == http.StatusGone {
+		changes, err = r.export(ctx, m.From, url.Values{"rect": {formatBound(m.Sector)}, "hold": {m.ID}})
+		if err == nil {
+			for _, id := range m.Moved {
+				if !slices.ContainsFunc(changes.Features, func(f *geojson.Feature) bool { return f.ID == id }) {
+					changes.Removed = append(changes.Removed, id)
+				}
+			}
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := r.apply(ctx, m, changes); err != nil {
+		return 0, err
+	}
+	return len(changes.Features) + len(changes.Removed), r.save(m)
+}
+
+// migrate runs a migration from its current phase to the end.
+func (r *Router) migrate(ctx context.Context, m *migration) error {
+	if m.ID == "" {
+		m.ID = newID()
+	}
+	if m.Phase == phaseCopy {
+		slog.Info("migration copy", slog.String("from", m.From), slog.String("to", m.To))
+		changes, err := r.export(ctx, m.From, url.Values{"rect": {formatBound(m.Sector)}, "hold": {m.ID}})
+		if err != nil {
+			return err
+		}
+		if err := r.apply(ctx, m, changes); err != nil {
+			return err
+		}
+		m.Phase = phaseTail
+		if err := r.save(m); err != nil {
+			return err
+		}
+	}
+
+	if m.Phase == phaseTail {
+		for range maxTailRounds {
+			n, err := r.tail(ctx, m)
+			if err != nil {
+				return err
+			}
+			if n <= quietTail {
+				break
+			}
+		}
+		if err := r.cutover(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	if m.Phase == phaseCleanup {
+		// writes that reached the old shard just before the flip
+		if _, err := r.tail(ctx, m); err != nil {
+			return err
+		}
+		if len(m.Moved) > 0 {
+			body, _ := json.Marshal(map[string][]string{"ids": m.Moved})
+			if _, err := r.post(ctx, m.From+"/evict", body); err != nil {
+				return err
+			}
+		}
+		if err := r.release(ctx, m); err != nil {
+			return err
+		}
+		m.Phase = phaseDone
+		slog.Info("migration done", slog.String("from", m.From), slog.String("to", m.To), slog.Int("moved", len(m.Moved)))
+		return r.save(m)
+	}
+	return nil
+}
+
+// fenceSector makes the old shard refuse the writes to the sector of the
+// migration, or accept them again with a nil sector.
+func (r *Router) fenceSector(ctx context.Context, m *migration, sector *[4]float64) error {
+	body, _ := json.Marshal(map[string]any{"fence": sector})
+	_, err := r.post(ctx, m.From+"/hold/"+url.PathEscape(m.ID), body)
+	return err
+}
+
+// release drops the hold of the migration on the old shard.
+func (r *Router) release(ctx context.Context, m *migration) error {
+	resp, err := r.fetch(ctx, "DELETE", m.From+"/hold/"+url.PathEscape(m.ID), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{code: resp.StatusCode, body: resp.Status}
+	}
+	return nil
+}
+
+// cutover fences the writes, on the Router and on the old shard for those
+// redirected to it already, copies the last changes and flips the routing
+// table. The old shard stays fenced until the migration is released.
+func (r *Router) cutover(ctx context.Context, m *migration) error {
+	r.fence.Lock()
+	defer r.fence.Unlock()
+	if err := r.fenceSector(ctx, m, &m.Sector); err != nil {
+		return err
+	}
+	err := func() error {
+		if _, err := r.tail(ctx, m); err != nil {
+			return err
+		}
+		return r.flip(m.Next)
+	}()
+	if err != nil {
+		// the old shard takes the writes again until the migration resumes
+		if ferr := r.fenceSector(ctx, m, nil); ferr != nil {
+			slog.Error("lifting migration fence", slog.String("from", m.From), slog.String("error", ferr.Error()))
+		}
+		return err
+	}
+	m.Phase = phaseCleanup
+	return r.save(m)
+}
+
+// run runs a migration, one at a time. A failed migration is kept to be
+// resumed.
+func (r *Router) run(ctx context.Context, m *migration) error {
+	if err := r.migrate(ctx, m); err != nil {
+		slog.Error("migration", slog.String("phase", m.Phase), slog.String("error", err.Error()))
+		m.Error = err.Error()
+		r.save(m)
+		return err
+	}
+	return nil
+}
+
+// resume continues a migration saved by a Router that was stopped.
+func (r *Router) resume() {
+	if r.tablePath == "" {
+		return
+	}
+	data, err := os.ReadFile(r.migrationPath())
+	if err != nil {
+		return
+	}
+	var m migration
+	if err := json.Unmarshal(data, &m); err != nil {
+		slog.Error("migration", slog.String("error", err.Error()))
+		return
+	}
+	if m.Phase == phaseCleanup {
+		// the flip was saved with the migration, make sure of the table
+		r.table.Store(m.Next)
+	}
+	r.moveMu.Lock()
+	r.record(&m)
+	go func() {
+		defer r.moveMu.Unlock()
+		slog.Info("resuming migration", slog.String("phase", m.Phase))
+		m.Error = ""
+		r.run(context.Background(), &m)
+	}()
+}
+
+// shift moves the features of a sector from one shard to another, towards
+// the next routing table. Without features to move, next is flipped to at
+// once. It returns the migration it ran, nil without one.
+func (r *Router) shift(ctx context.Context, sector orb.Bound, from, to string, next *RoutingTable) (*migration, error) {
+	if from == to {
+		return nil, r.flip(next)
+	}
+	m := &migration{Phase: phaseCopy, Sector: fromBound(sector), From: from, To: to, Moved: []string{}, Next: next}
+	if err := r.save(m); err != nil {
+		return nil, err
+	}
+	return m, r.run(ctx, m)
+}
+
+// start shifts a sector for a rebalance request, see shift.
+func (r *Router) start(w http.ResponseWriter, req *http.Request, sector orb.Bound, from, to string, next *RoutingTable) {
+	// the migration goes on if the client goes away
+	m, err := r.shift(context.WithoutCancel(req.Context()), sector, from, to, next)
+	switch {
+	case err != nil && m == nil:
+		writeError(w, err)
+	case err != nil:
+		http.Error(w, "migration failed, resume it: "+err.Error(), http.StatusBadGateway)
+	case m == nil:
+		writeJSON(w, map[string]any{"table": next})
+	default:
+		writeJSON(w, map[string]any{"moved": len(m.Moved), "table": next})
+	}
+}
+
+// lock takes the right to change the routing table, refused while a
+// migration is pending.
+func (r *Router) lock(w http.ResponseWriter) bool {
+	if !r.moveMu.TryLock() {
+		http.Error(w, errMigrating.Error(), http.StatusConflict)
+		return false
+	}
+	r.migMu.Lock()
+	pending := r.moving != nil && r.moving.Phase != phaseDone
+	r.migMu.Unlock()
+	if pending {
+		r.moveMu.Unlock()
+		http.Error(w, "a failed migration is pending, resume it", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+type rebalanceRequest struct {
+	Sector  [4]float64   `json:"sector"`
+	Sectors [][4]float64 `json:"sectors"`
+	To      string       `json:"to"`
+}
+
+func readRebalance(w http.ResponseWriter, req *http.Request) (*rebalanceRequest, bool) {
+	var data rebalanceRequest
+	if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return nil, false
+	}
+	return &data, true
+}
+
+// sectorShard returns the shard of the sector with the bound.
+func sectorShard(table *RoutingTable, bound orb.Bound) (*Shard, bool) {
+	s := table.findSector(bound)
+	if s == nil {
+		return nil, false
+	}
+	return s.shard, true
+}
+
+// rebalanceMove moves a sector to the shard with the leader address to.
+func (r *Router) rebalanceMove(w http.ResponseWriter, req *http.Request) {
+	data, ok := readRebalance(w, req)
+	if !ok || !r.lock(w) {
+		return
+	}
+	defer r.moveMu.Unlock()
+	table := r.routes()
+	sector := toBound(data.Sector)
+	from, ok := sectorShard(table, sector)
+	if !ok || data.To == "" {
+		http.Error(w, "unknown sector or shard", http.StatusBadRequest)
+		return
+	}
+	next, _ := table.Assign(sector, table.shard(data.To))
+	r.start(w, req, sector, from.LeaderAddr, data.To, next)
+}
+
+// rebalanceSplit cuts a hot sector in two halves, and moves the second one,
+// east or north, to the shard with the leader address to, if given.
+func (r *Router) rebalanceSplit(w http.ResponseWriter, req *http.Request) {
+	data, ok := readRebalance(w, req)
+	if !ok || !r.lock(w) {
+		return
+	}
+	defer r.moveMu.Unlock()
+	table := r.routes()
+	sector := toBound(data.Sector)
+	from, ok := sectorShard(table, sector)
+	if !ok {
+		http.Error(w, errNoSector.Error(), http.StatusBadRequest)
+		return
+	}
+	next, halves, _ := table.Split(sector)
+	to := from.LeaderAddr
+	if data.To != "" {
+		to = data.To
+		next, _ = next.Assign(halves[1], next.shard(to))
+	}
+	r.start(w, req, halves[1], from.LeaderAddr, to, next)
+}
+
+// rebalanceMerge joins two cold neighbour sectors into one on the shard of
+// the first, moving the features of the second there.
+func (r *Router) rebalanceMerge(w http.ResponseWriter, req *http.Request) {
+	data, ok := readRebalance(w, req)
+	if !ok || !r.lock(w) {
+		return
+	}
+	defer r.moveMu.Unlock()
+	if len(data.Sectors) != 2 {
+		http.Error(w, "two sectors are merged", http.StatusBadRequest)
+		return
+	}
+	table := r.routes()
+	a, b := toBound(data.Sectors[0]), toBound(data.Sectors[1])
+	to, okA := sectorShard(table, a)
+	from, okB := sectorShard(table, b)
+	if !okA || !okB {
+		http.Error(w, errNoSector.Error(), http.StatusBadRequest)
+		return
+	}
+	assigned, _ := table.Assign(b, to)
+	next, err := assigned.Merge(a, b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.start(w, req, b, from.LeaderAddr, to.LeaderAddr, next)
+}
+
+// rebalanceResume runs a failed migration again from where it stopped.
+func (r *Router) rebalanceResume(w http.ResponseWriter, req *http.Request) {
+	if !r.moveMu.TryLock() {
+		http.Error(w, errMigrating.Error(), http.StatusConflict)
+		return
+	}
+	defer r.moveMu.Unlock()
+	r.migMu.Lock()
+	var m migration
+	if r.moving != nil {
+		m = *r.moving
+		m.Moved = slices.Clone(r.moving.Moved)
+	}
+	r.migMu.Unlock()
+	if m.Phase == "" || m.Phase == phaseDone {
+		http.Error(w, "no migration to resume", http.StatusNotFound)
+		return
+	}
+	m.Error = ""
+	if err := r.run(context.WithoutCancel(req.Context()), &m); err != nil {
+		http.Error(w, "migration failed, resume it: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, map[string]any{"moved": len(m.Moved), "table": m.Next})
+}
+
+// rebalanceStatus answers with the routing table and the last migration.
+func (r *Router) rebalanceStatus(w http.ResponseWriter, req *http.Request) {
+	r.migMu.Lock()
+	m := r.moving
+	r.migMu.Unlock()
+	status := map[string]any{"table": r.routes(), "migration": m}
+	if r.meta != nil {
+		status["version"], _ = r.meta.current()
+	}
+	writeJSON(w, status)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// peerQueue is how many transactions may wait for a slow replica before
+	// it is disconnected.
+	peerQueue = 1024
+
+	minBackoff       = 100 * time.Millisecond
+	maxBackoff       = 5 * time.Second
+	handshakeTimeout = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{}
+
+// peer is a replica connected to the /replication endpoint. Local
+// transactions are queued to it and written by its own goroutine.
+type peer struct {
+	name string
+	conn *websocket.Conn
+	send chan *Transaction
+
+	// what the replica missed while disconnected, see attach
+	snapshot *checkpointSnapshot
+	backlog  []*Transaction
+}
+
+func (p *peer) write() {
+	defer p.conn.Close()
+	if p.snapshot != nil {
+		if err := p.conn.WriteJSON(p.snapshot); err != nil {
+			slog.Error("replication write", slog.String("peer", p.name), slog.String("error", err.Error()))
+			return
+		}
+	}
+	for _, txn := range p.backlog {
+		if err := p.conn.WriteJSON(txn); err != nil {
+			slog.Error("replication write", slog.String("peer", p.name), slog.String("error", err.Error()))
+			return
+		}
+	}
+	for txn := range p.send {
+		if err := p.conn.WriteJSON(txn); err != nil {
+			slog.Error("replication write", slog.String("peer", p.name), slog.String("error", err.Error()))
+			return
+		}
+	}
+}
+
+// register adds a peer to the registry, replacing an older connection of
+// the same replica.
+func (e *Engine) register(p *peer) {
+	e.peersMu.Lock()
+	defer e.peersMu.Unlock()
+	if old, ok := e.peers[p.name]; ok {
+		close(old.send)
+	}
+	e.peers[p.name] = p
+}
+
+func (e *Engine) unregister(p *peer) {
+	e.peersMu.Lock()
+	defer e.peersMu.Unlock()
+	if e.peers[p.name] == p {
+		delete(e.peers, p.name)
+		close(p.send)
+	}
+}
+
+// broadcast queues a local transaction to every registered peer. Peers that
+// can't keep up are dropped and have to reconnect.
+func (e *Engine) broadcast(txn *Transaction) {
+	e.peersMu.Lock()
+	defer e.peersMu.Unlock()
+	for name, p := range e.peers {
+		select {
+		case p.send <- txn:
+		default:
+			slog.Error("replica is too slow, dropping", slog.String("peer", name))
+			delete(e.peers, name)
+			close(p.send)
+		}
+	}
+}
+
+// replicationURL turns a replica address such as http://127.0.0.1:8080/storage
+// into the url of its websocket /replication endpoint.
+func replicationURL(addr, name string) (string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path += "/replication"
+	u.RawQuery = url.Values{"name": {name}}.Encode()
+	return u.String(), nil
+}
+
+// connect keeps a connection to the replica at addr and passes the
+// transactions it sends to the engine. The connection starts with the
+// vector clock, so the replica can send what was missed. It reconnects
+// with exponential backoff until the engine is stopped.
+func (e *Engine) connect(addr string) {
+	target, err := replicationURL(addr, e.name)
+	if err != nil {
+		slog.Error("invalid replica address", slog.String("addr", addr), slog.String("error", err.Error()))
+		return
+	}
+	backoff := minBackoff
+	for {
+		conn, _, err := websocket.DefaultDialer.DialContext(e.ctx, target, nil)
+		if err == nil {
+			err = conn.WriteJSON(e.clock())
+		}
+		if err == nil {
+			backoff = minBackoff
+			e.receive(conn)
+		} else {
+			slog.Debug("replica is unavailable", slog.String("addr", addr), slog.String("error", err.Error()))
+		}
+		select {
+		case <-time.After(backoff):
+			backoff = min(2*backoff, maxBackoff)
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// receive reads transactions and snapshots from a replica until the
+// connection breaks, the engine resyncs or is stopped. Every message is
+// acknowledged with the LSN of the replica persisted since.
+func (e *Engine) receive(conn *websocket.Conn) {
+	e.mu.Lock()
+	redial := e.redial
+	e.mu.Unlock()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-e.ctx.Done():
+		case <-redial:
+		case <-done:
+		}
+		conn.Close()
+	}()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		name, err := e.dispatch(data)
+		if err != nil {
+			slog.Error("invalid replication message", slog.String("error", err.Error()))
+			return
+		}
+		if err := conn.WriteJSON(&ack{LSN: e.clock()[name]}); err != nil {
+			return
+		}
+	}
+}
+
+// replicate logs and applies a transaction received from a replica. It
+// keeps the name, LSN and version given by the node that made it.
+// Transactions already applied, as told by the vector clock, and those of a
+// deposed leader are dropped.
+func (e *Engine) replicate(txn *Transaction) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.seen(txn) {
+		slog.Debug("duplicate transaction", slog.String("name", txn.Name), slog.Uint64("lsn", txn.LSN))
+		return nil
+	}
+	if e.fenced(txn) {
+		slog.Info("fenced transaction", slog.String("name", txn.Name), slog.Uint64("lsn", txn.LSN), slog.Uint64("term", txn.Term))
+		return nil
+	}
+
+	// the Seq of the sender doesn't order the history here
+	e.seq++
+	txn.Seq = e.seq
+	data, err := json.Marshal(txn)
+	if err != nil {
+		return err
+	}
+	txn.size = int64(len(data))
+	if _, err := e.logFile.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	e.tick(txn)
+	e.history = append(e.history, txn)
+	_, err = e.applyTransaction(txn)
+	return err
+}
+
+// replicationHandler registers the connecting replica, named by the name
+// query parameter, and streams local transactions to it, starting after
+// the vector clock the replica sends first.
+func (s *Storage) replicationHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "replica name is required", http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	var vclock map[string]uint64
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.ReadJSON(&vclock); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	slog.Info("replica connected", slog.String("storage", s.name), slog.String("replica", name))
+	p := &peer{name: name, conn: conn, send: make(chan *Transaction, peerQueue)}
+	s.eng.attach(p, vclock)
+	go p.write()
+
+	// replicas send acks until they disconnect
+	for {
+		var a ack
+		if err := conn.ReadJSON(&a); err != nil {
+			break
+		}
+		s.eng.ack(name, a.LSN)
+	}
+	s.eng.unregister(p)
+	slog.Info("replica disconnected", slog.String("storage", s.name), slog.String("replica", name))
+}
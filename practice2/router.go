@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// Router sends requests to the shards of the routing table. Requests that
+// belong to one shard are redirected to its leader with 307, or proxied to
+// it, see WithProxy. The others are answered by querying every shard.
+type Router struct {
+	mux    *http.ServeMux
+	table  atomic.Pointer[RoutingTable]
+	client *http.Client
+
+	proxy       bool
+	proxyClient *http.Client
+	timeout     time.Duration
+	retries     int
+
+	// the routing table and the migration in progress are saved next to
+	// each other, see rebalance.go
+	tablePath string
+	// writes hold it for reading, the cutover of a migration for writing
+	fence  sync.RWMutex
+	moveMu sync.Mutex
+	migMu  sync.Mutex
+	moving *migration
+
+	// features moving between shards by id, see move.go
+	movesMu sync.Mutex
+	moves   map[string]moveIntent
+	idLocks map[string]*idLock
+
+	// bulk imports by id, see bulk.go
+	importMu sync.Mutex
+	imports  map[string]*importState
+
+	// the health of the nodes, see health.go
+	healthInterval time.Duration
+	checkClient    *http.Client
+	healthMu       sync.Mutex
+	nodes          map[string]*nodeState
+
+	// the load of the sectors and the split policy, see loadstats.go
+	load      *loadHistogram
+	policy    *SplitPolicy
+	statsMu   sync.Mutex
+	proposals []splitProposal
+
+	// the metadata Storage the routing table is watched on, see metadata.go
+	meta   *tableWatch
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// RouterOption configures a Router.
+type RouterOption func(*Router)
+
+func NewRouter(mux *http.ServeMux, table *RoutingTable, opts ...RouterOption) *Router {
+	r := &Router{
+		mux:     mux,
+		timeout: defaultProxyTimeout,
+		moves:   make(map[string]moveIntent),
+		idLocks: make(map[string]*idLock),
+		imports: make(map[string]*importState),
+		load:    newLoadHistogram(),
+
+		healthInterval: defaultHealthInterval,
+		nodes:          make(map[string]*nodeState),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.table.Store(table)
+	for _, opt := range opts {
+		opt(r)
+	}
+	local := &localTransport{mux: mux, next: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdlePerShard,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: r.timeout,
+	}}
+	transport := &observedTransport{r: r, next: local}
+	// health checks count their outcome themselves
+	r.checkClient = &http.Client{Timeout: r.timeout, Transport: local}
+	r.client = &http.Client{
+		Timeout:   r.timeout,
+		Transport: transport,
+		// redirects between Storages are for clients, not the Router
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	// the proxy follows them, the topology stays behind the Router
+	r.proxyClient = &http.Client{Timeout: r.timeout, Transport: transport}
+	if r.meta != nil {
+		// watches wait longer than requests to Storages
+		r.meta.client = &http.Client{Transport: transport}
+		r.meta.onChange = func(next *RoutingTable) { r.table.Store(next) }
+	}
+
+	mux.Handle("/", http.FileServer(http.Dir("../front/dist")))
+	r.handle("/insert", r.fenced(r.routeWrite))
+	r.handle("/replace", r.fenced(r.routeWrite))
+	r.handle("/delete", r.fenced(r.routeBody))
+	r.handle("/undelete", r.fenced(r.routeBody))
+	r.handle("/feature/{id}", r.fenced(r.routeID))
+	r.handle("/feature/{id}/history", r.routeID)
+	r.handle("/select", r.routeSelect)
+	r.handle("/trash", r.routeTrash)
+	r.handle("POST /features:get", r.routeMultiGet)
+	r.handle("/checkpoint", r.routeCheckpoint)
+	r.handle("GET /rebalance", r.rebalanceStatus)
+	r.handle("POST /rebalance/move", r.rebalanceMove)
+	r.handle("POST /rebalance/split", r.rebalanceSplit)
+	r.handle("POST /rebalance/merge", r.rebalanceMerge)
+	r.handle("POST /rebalance/resume", r.rebalanceResume)
+	r.handle("POST /rebalance/evaluate", r.rebalanceEvaluate)
+	r.handle("GET /stats", r.routerStats)
+	r.handle("GET /cluster", r.clusterHandler)
+	r.handle("POST /import", r.routeImport)
+	r.handle("GET /import/{id}", r.importStatus)
+	return r
+}
+
+func (r *Router) Run() {
+	slog.Info("Router started")
+	r.watchMetadata()
+	r.resumeMoves()
+	r.loadImports()
+	r.resume()
+	go r.checkHealth()
+	go r.enforce()
+}
+
+// routes returns the routing table in use.
+func (r *Router) routes() *RoutingTable {
+	return r.table.Load()
+}
+
+func (r *Router) Stop() {
+	r.cancel()
+	slog.Info("Router stopped")
+}
+
+// routeWrite redirects an insert or replace to the leader of the shard of
+// the feature's geometry.
+func (r *Router) routeWrite(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	rewind(req, body)
+	feature, ok := readFeature(w, req)
+	if !ok {
+		return
+	}
+	table := r.routes()
+	var id string
+	made := false
+	if feature.ID != nil {
+		if id, err = parseID(feature.ID); err != nil {
+			writeError(w, err)
+			return
+		}
+	} else if table.Owner(id) != nil {
+		// the shard depends on the id, so the Router makes it
+		id, made = newID(), true
+		feature.ID = id
+		if body, err = feature.MarshalJSON(); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	rewind(req, body)
+	shard, err := table.Locate(id, feature.Geometry.Bound())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s := table.locate(feature.Geometry.Bound()); s != nil && table.Owner(id) == nil {
+		r.load.record(loadWrite, len(body), fromBound(s.bound))
+	}
+	if made {
+		// a client redirected would send its body, without the id
+		r.proxyTo(w, req, shard.LeaderAddr)
+		return
+	}
+	if id != "" {
+		defer r.lockID(id)()
+		if _, moving := r.intent(id); moving {
+			writeError(w, errMoving)
+			return
+		}
+	}
+	if strings.HasSuffix(req.URL.Path, "/replace") {
+		// the feature left the sectors of its shard
+		if from := r.holder(req.Context(), id, shard); from != nil {
+			r.move(w, req, id, from, shard, feature)
+			return
+		}
+	}
+	r.forward(w, req, shard.LeaderAddr)
+}
+
+// routeBody redirects a delete or undelete, which name the feature by the
+// id in the body, to the shard that has it.
+func (r *Router) routeBody(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	var data struct {
+		ID any `json:"id"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	id, err := parseID(data.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rewind(req, body)
+	r.routeTo(w, req, id)
+}
+
+// routeID redirects a request for a feature by id to the shard that has it.
+func (r *Router) routeID(w http.ResponseWriter, req *http.Request) {
+	id, err := parseID(req.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	r.routeTo(w, req, id)
+}
+
+func (r *Router) routeTo(w http.ResponseWriter, req *http.Request, id string) {
+	if !idempotent(req.Method) {
+		defer r.lockID(id)()
+	}
+	if m, moving := r.intent(id); moving {
+		if !idempotent(req.Method) {
+			writeError(w, errMoving)
+			return
+		}
+		// reads go to the copy that is visible
+		addr := m.From
+		if m.Phase == moveCommit {
+			addr = m.To
+		}
+		r.forward(w, req, addr)
+		return
+	}
+	shards := r.routes().Shards()
+	if len(shards) == 1 {
+		r.forward(w, req, shards[0].LeaderAddr)
+		return
+	}
+	if shard := r.routes().Owner(id); shard != nil {
+		r.forward(w, req, shard.LeaderAddr)
+		return
+	}
+	shard := r.find(req.Context(), id)
+	if shard == nil {
+		writeError(w, errNotFound)
+		return
+	}
+	r.forward(w, req, shard.LeaderAddr)
+}
+
+// find asks the shards which one has a feature, live or in the trash. A
+// feature on several shards, as while it is moved, is found on the one the
+// routing table assigns it to.
+func (r *Router) find(ctx context.Context, id string) *Shard {
+	table := r.routes()
+	var found *Shard
+	for _, shard := range table.Shards() {
+		resp, err := r.fetch(ctx, "GET", shard.LeaderAddr+"/feature/"+id, nil)
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || (resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMultipleChoices) {
+			continue
+		}
+		if found == nil {
+			found = shard
+		}
+		if feature, err := geojson.UnmarshalFeature(data); err == nil && feature.Geometry != nil {
+			if owner, err := table.Locate(id, feature.Geometry.Bound()); err == nil && owner == shard {
+				return shard
+			}
+		}
+	}
+	if found != nil {
+		return found
+	}
+	for _, shard := range table.Shards() {
+		var trash *geojson.FeatureCollection
+		if err := r.fetchCollection(ctx, "GET", shard.LeaderAddr+"/trash", nil, &trash); err != nil {
+			continue
+		}
+		for _, feature := range trash.Features {
+			if feature.ID == id {
+				return shard
+			}
+		}
+	}
+	return nil
+}
+
+// fetch makes a request to a Storage of a shard on behalf of the request
+// of ctx, whose id it passes on.
+func (r *Router) fetch(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		req.Header.Set(requestIDHeader, id)
+	}
+	if version := r.routedWith(); version != "" {
+		req.Header.Set(routingVersionHeader, version)
+	}
+	resp, err := r.client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusMisdirectedRequest {
+		r.refresh(ctx)
+	}
+	return resp, err
+}
+
+// fetchCollection makes a request answered with a feature collection.
+func (r *Router) fetchCollection(ctx context.Context, method, url string, body []byte, col **geojson.FeatureCollection) error {
+	resp, err := r.fetch(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{code: resp.StatusCode, body: strings.TrimSpace(string(data))}
+	}
+	*col, err = geojson.UnmarshalFeatureCollection(data)
+	return err
+}
+
+// statusError is an error status answered by a shard.
+type statusError struct {
+	code int
+	body string
+}
+
+func (err *statusError) Error() string {
+	return http.StatusText(err.code) + ": " + err.body
+}
+
+// gather makes the same request to the shards in parallel, to their leaders
+// or to a replica while the leader is out of rotation, and returns their
+// feature collections and errors in shard order. Shards answering 404 have
+// nothing to add.
+func (r *Router) gather(ctx context.Context, method, path string, body []byte, shards []*Shard) ([]*geojson.FeatureCollection, []error) {
+	cols := make([]*geojson.FeatureCollection, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = r.fetchCollection(ctx, method, r.live(shard.LeaderAddr)+path, body, &cols[i])
+			var status *statusError
+			if errors.As(errs[i], &status) && status.code == http.StatusNotFound {
+				cols[i], errs[i] = geojson.NewFeatureCollection(), nil
+			}
+		}()
+	}
+	wg.Wait()
+	return cols, errs
+}
+
+func writeCollection(w http.ResponseWriter, col *geojson.FeatureCollection) {
+	data, err := col.MarshalJSON()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// sortByID orders features by id, the order Storages select them in.
+func sortByID(features []*geojson.Feature) {
+	slices.SortFunc(features, func(a, b *geojson.Feature) int {
+		return strings.Compare(a.ID.(string), b.ID.(string))
+	})
+}
+
+// routeTrash merges the trash of all shards.
+func (r *Router) routeTrash(w http.ResponseWriter, req *http.Request) {
+	shards := r.routes().Shards()
+	if len(shards) == 1 {
+		r.forward(w, req, shards[0].LeaderAddr)
+		return
+	}
+	cols, errs := r.gather(req.Context(), "GET", "/trash", nil, shards)
+	if err := errors.Join(errs...); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	merged := geojson.NewFeatureCollection()
+	deletedAt := map[string]any{}
+	for _, col := range cols {
+		merged.Features = append(merged.Features, col.Features...)
+		if times, ok := col.ExtraMembers["deletedAt"].(map[string]any); ok {
+			for id, ts := range times {
+				deletedAt[id] = ts
+			}
+		}
+	}
+	sortByID(merged.Features)
+	merged.ExtraMembers = geojson.Properties{"deletedAt": deletedAt}
+	writeCollection(w, merged)
+}
+
+// routeMultiGet asks every shard for the ids and merges what they found.
+func (r *Router) routeMultiGet(w http.ResponseWriter, req *http.Request) {
+	shards := r.routes().Shards()
+	if len(shards) == 1 {
+		r.forward(w, req, shards[0].LeaderAddr)
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	var data struct {
+		IDs []any `json:"ids"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil || len(data.IDs) == 0 {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	cols, errs := r.gather(req.Context(), "POST", "/features:get", body, shards)
+	if err := errors.Join(errs...); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	merged := geojson.NewFeatureCollection()
+	versions := map[string]any{}
+	for i, col := range cols {
+		hidden := map[string]bool{}
+		for _, feature := range col.Features {
+			if id := feature.ID.(string); r.hidden(id, shards[i].LeaderAddr) {
+				hidden[id] = true
+				continue
+			}
+			merged.Features = append(merged.Features, feature)
+		}
+		if v, ok := col.ExtraMembers["versions"].(map[string]any); ok {
+			for id, version := range v {
+				if !hidden[id] {
+					versions[id] = version
+				}
+			}
+		}
+	}
+	if len(merged.Features) == 0 {
+		writeError(w, errNotFound)
+		return
+	}
+	var missing []string
+	for _, raw := range data.IDs {
+		if id, err := parseID(raw); err == nil && versions[id] == nil && !slices.Contains(missing, id) {
+			missing = append(missing, id)
+		}
+	}
+	merged.ExtraMembers = geojson.Properties{"versions": versions}
+	if len(missing) > 0 {
+		merged.ExtraMembers["missing"] = missing
+	}
+	writeCollection(w, merged)
+}
+
+// routeCheckpoint checkpoints the leaders of all shards.
+func (r *Router) routeCheckpoint(w http.ResponseWriter, req *http.Request) {
+	shards := r.routes().Shards()
+	if len(shards) == 1 {
+		r.forward(w, req, shards[0].LeaderAddr)
+		return
+	}
+	for _, shard := range shards {
+		resp, err := r.fetch(req.Context(), req.Method, shard.LeaderAddr+"/checkpoint", nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			http.Error(w, "can't checkpoint "+shard.LeaderAddr, resp.StatusCode)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// localTransport serves requests for addresses without a host, such as
+// /storage/select, with the Router's own mux.
+type localTransport struct {
+	mux  *http.ServeMux
+	next http.RoundTripper
+}
+
+func (t *localTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != "" {
+		return t.next.RoundTrip(req)
+	}
+	w := &bufferedResponse{header: http.Header{}}
+	t.mux.ServeHTTP(w, req)
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	resp := &http.Response{
+		StatusCode: w.code,
+		Status:     http.StatusText(w.code),
+		Header:     w.header,
+		Body:       io.NopCloser(&w.body),
+		Request:    req,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	return resp, nil
+}
+
+// bufferedResponse is an http.ResponseWriter that keeps the response.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header { return w.header }
+
+func (w *bufferedResponse) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *bufferedResponse) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(data)
+}
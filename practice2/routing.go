@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/paulmach/orb"
+	"github.com/tidwall/rtree"
+)
+
+// world is the whole map, split into sectors by the routing table.
+var world = orb.Bound{Min: orb.Point{-180, -90}, Max: orb.Point{180, 90}}
+
+var errOutsideMap = errors.New("geometry is outside the routing table")
+
+// Shard is a replica set of Storages holding the features of some sectors
+// of the map. Addresses are like http://127.0.0.1:8080/storage, or
+// /storage for a Storage on the Router's own mux.
+type Shard struct {
+	LeaderAddr string   `json:"leaderAddr"`
+	Replicas   []string `json:"replicas"`
+}
+
+// sector is an area of the map and the shard holding its features.
+type sector struct {
+	bound orb.Bound
+	shard *Shard
+	index int
+}
+
+// RoutingTable is an rtree of the map sectors laid out by a sharding
+// strategy. A feature belongs to the shard of the sector holding the center
+// of its bound, so features spanning several sectors are assigned
+// deterministically. Strategies sharding by id have no sectors.
+type RoutingTable struct {
+	strategy ShardingStrategy
+	tree     rtree.RTree
+	sectors  []*sector
+	shards   []*Shard
+}
+
+// NewRoutingTable returns an empty table to lay out by hand with Add.
+func NewRoutingTable() *RoutingTable {
+	return &RoutingTable{}
+}
+
+// NewShardedTable splits the map among the shards with the strategy.
+func NewShardedTable(strategy ShardingStrategy, shards []*Shard) *RoutingTable {
+	t := &RoutingTable{strategy: strategy, shards: slices.Clone(shards)}
+	for _, s := range strategy.Sectors(shards) {
+		t.Add(s.bound, s.shard)
+	}
+	return t
+}
+
+// NewGridTable splits the map into vertical strips, one for every row of
+// nodes: the names of the leader and the replicas of a shard, all on the
+// Router's mux.
+func NewGridTable(nodes [][]string) *RoutingTable {
+	shards := make([]*Shard, 0, len(nodes))
+	for _, row := range nodes {
+		shard := &Shard{LeaderAddr: "/" + row[0]}
+		for _, replica := range row[1:] {
+			shard.Replicas = append(shard.Replicas, "/"+replica)
+		}
+		shards = append(shards, shard)
+	}
+	return NewShardedTable(&GridStrategy{Columns: len(nodes), Rows: 1}, shards)
+}
+
+// Add maps a sector of the map to a shard. Sectors added first win where
+// sectors overlap, their borders included.
+func (t *RoutingTable) Add(bound orb.Bound, shard *Shard) {
+	s := &sector{bound: bound, shard: shard, index: len(t.sectors)}
+	t.sectors = append(t.sectors, s)
+	t.tree.Insert(bound.Min, bound.Max, s)
+	if !slices.Contains(t.shards, shard) {
+		t.shards = append(t.shards, shard)
+	}
+}
+
+// Shards returns the shards in the order they were added.
+func (t *RoutingTable) Shards() []*Shard {
+	return t.shards
+}
+
+// Owner returns the shard of a feature id when the strategy shards by id,
+// nil otherwise.
+func (t *RoutingTable) Owner(id string) *Shard {
+	if t.strategy == nil || len(t.shards) == 0 {
+		return nil
+	}
+	return t.strategy.Owner(id, t.shards)
+}
+
+// search returns the sectors intersecting bound in the order they were
+// added.
+func (t *RoutingTable) search(bound orb.Bound) []*sector {
+	var found []*sector
+	t.tree.Search(bound.Min, bound.Max, func(min, max [2]float64, data interface{}) bool {
+		found = append(found, data.(*sector))
+		return true
+	})
+	slices.SortFunc(found, func(a, b *sector) int { return a.index - b.index })
+	return found
+}
+
+// Locate returns the shard of a feature: the owner of its id, or the shard
+// of the first sector holding the center of its bound or, if the center is
+// in none, of the sector overlapping the bound the most.
+func (t *RoutingTable) Locate(id string, bound orb.Bound) (*Shard, error) {
+	if shard := t.Owner(id); shard != nil {
+		return shard, nil
+	}
+	s := t.locate(bound)
+	if s == nil {
+		return nil, errOutsideMap
+	}
+	return s.shard, nil
+}
+
+// locate returns the sector a bound belongs to, see Locate.
+func (t *RoutingTable) locate(bound orb.Bound) *sector {
+	center := bound.Center()
+	if found := t.search(orb.Bound{Min: center, Max: center}); len(found) > 0 {
+		return found[0]
+	}
+	var best *sector
+	var bestArea float64
+	for _, s := range t.search(bound) {
+		width := min(s.bound.Max.X(), bound.Max.X()) - max(s.bound.Min.X(), bound.Min.X())
+		height := min(s.bound.Max.Y(), bound.Max.Y()) - max(s.bound.Min.Y(), bound.Min.Y())
+		if area := width * height; best == nil || area > bestArea {
+			best, bestArea = s, area
+		}
+	}
+	return best
+}
+
+// Overlapping returns the shards with sectors intersecting bound, all of
+// them if bound is nil or the table has no sectors.
+func (t *RoutingTable) Overlapping(bound *orb.Bound) []*Shard {
+	if bound == nil || len(t.sectors) == 0 {
+		return t.shards
+	}
+	var shards []*Shard
+	for _, s := range t.search(*bound) {
+		if !slices.Contains(shards, s.shard) {
+			shards = append(shards, s.shard)
+		}
+	}
+	return shards
+}
+
+var errNoSector = errors.New("no sector with this bound")
+
+// findSector returns the sector with exactly the bound.
+func (t *RoutingTable) findSector(bound orb.Bound) *sector {
+	for _, s := range t.sectors {
+		if s.bound == bound {
+			return s
+		}
+	}
+	return nil
+}
+
+// rebuild returns a table with the strategy and shards of t and the given
+// sectors, in order. Tables are not changed once routing, changes make new
+// ones that replace them at once.
+func (t *RoutingTable) rebuild(sectors []*sector) *RoutingTable {
+	next := &RoutingTable{strategy: t.strategy, shards: slices.Clone(t.shards)}
+	for _, s := range sectors {
+		next.Add(s.bound, s.shard)
+	}
+	return next
+}
+
+// Split returns a table where the sector with the bound is cut in two
+// halves across its longer side, both on the same shard.
+func (t *RoutingTable) Split(bound orb.Bound) (*RoutingTable, [2]orb.Bound, error) {
+	var halves [2]orb.Bound
+	s := t.findSector(bound)
+	if s == nil {
+		return nil, halves, errNoSector
+	}
+	halves[0], halves[1] = bound, bound
+	center := bound.Center()
+	if bound.Max.X()-bound.Min.X() >= bound.Max.Y()-bound.Min.Y() {
+		halves[0].Max[0], halves[1].Min[0] = center.X(), center.X()
+	} else {
+		halves[0].Max[1], halves[1].Min[1] = center.Y(), center.Y()
+	}
+	var sectors []*sector
+	for _, o := range t.sectors {
+		if o == s {
+			sectors = append(sectors, &sector{bound: halves[0], shard: s.shard}, &sector{bound: halves[1], shard: s.shard})
+		} else {
+			sectors = append(sectors, o)
+		}
+	}
+	return t.rebuild(sectors), halves, nil
+}
+
+// Assign returns a table where the sector with the bound belongs to the
+// shard, which is added if new.
+func (t *RoutingTable) Assign(bound orb.Bound, shard *Shard) (*RoutingTable, error) {
+	s := t.findSector(bound)
+	if s == nil {
+		return nil, errNoSector
+	}
+	var sectors []*sector
+	for _, o := range t.sectors {
+		if o == s {
+			o = &sector{bound: o.bound, shard: shard}
+		}
+		sectors = append(sectors, o)
+	}
+	return t.rebuild(sectors), nil
+}
+
+// Merge returns a table where two neighbour sectors of the same shard,
+// together a rectangle, are one.
+func (t *RoutingTable) Merge(a, b orb.Bound) (*RoutingTable, error) {
+	sa, sb := t.findSector(a), t.findSector(b)
+	if sa == nil || sb == nil || sa == sb {
+		return nil, errNoSector
+	}
+	if sa.shard != sb.shard {
+		return nil, errors.New("sectors are on different shards")
+	}
+	union := a.Union(b)
+	sideBySide := a.Min.Y() == b.Min.Y() && a.Max.Y() == b.Max.Y() && (a.Max.X() == b.Min.X() || b.Max.X() == a.Min.X())
+	stacked := a.Min.X() == b.Min.X() && a.Max.X() == b.Max.X() && (a.Max.Y() == b.Min.Y() || b.Max.Y() == a.Min.Y())
+	if !sideBySide && !stacked {
+		return nil, errors.New("sectors don't make a rectangle")
+	}
+	var sectors []*sector
+	merged := false
+	for _, o := range t.sectors {
+		if o != sa && o != sb {
+			sectors = append(sectors, o)
+		} else if !merged {
+			sectors = append(sectors, &sector{bound: union, shard: sa.shard})
+			merged = true
+		}
+	}
+	return t.rebuild(sectors), nil
+}
+
+// shard returns the shard with the leader address, or a new one.
+func (t *RoutingTable) shard(leaderAddr string) *Shard {
+	for _, shard := range t.shards {
+		if shard.LeaderAddr == leaderAddr {
+			return shard
+		}
+	}
+	return &Shard{LeaderAddr: leaderAddr}
+}
+
+// tableFile is the routing table as saved: the strategy that laid it out,
+// the shards and the sectors, which name their shard by index.
+type tableFile struct {
+	Strategy string          `json:"strategy,omitempty"`
+	Params   json.RawMessage `json:"params,omitempty"`
+	Shards   []*Shard        `json:"shards"`
+	Sectors  []tableSector   `json:"sectors"`
+}
+
+type tableSector struct {
+	Bound [4]float64 `json:"bound"`
+	Shard int        `json:"shard"`
+}
+
+func (t *RoutingTable) MarshalJSON() ([]byte, error) {
+	file := tableFile{Shards: t.shards, Sectors: []tableSector{}}
+	if t.strategy != nil {
+		params, err := json.Marshal(t.strategy)
+		if err != nil {
+			return nil, err
+		}
+		file.Strategy, file.Params = t.strategy.Kind(), params
+	}
+	for _, s := range t.sectors {
+		file.Sectors = append(file.Sectors, tableSector{
+			Bound: [4]float64{s.bound.Min.X(), s.bound.Min.Y(), s.bound.Max.X(), s.bound.Max.Y()},
+			Shard: slices.Index(t.shards, s.shard),
+		})
+	}
+	return json.Marshal(file)
+}
+
+// UnmarshalJSON restores a saved table. The sectors are taken as saved, not
+// laid out again by the strategy, so changes to them are kept.
+func (t *RoutingTable) UnmarshalJSON(data []byte) error {
+	var file tableFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	*t = RoutingTable{shards: file.Shards}
+	if file.Strategy != "" {
+		strategy, err := newStrategy(file.Strategy)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(file.Params, strategy); err != nil {
+			return err
+		}
+		t.strategy = strategy
+	}
+	for _, s := range file.Sectors {
+		if s.Shard < 0 || s.Shard >= len(t.shards) {
+			return fmt.Errorf("sector of unknown shard %d", s.Shard)
+		}
+		t.Add(orb.Bound{Min: orb.Point{s.Bound[0], s.Bound[1]}, Max: orb.Point{s.Bound[2], s.Bound[3]}}, t.shards[s.Shard])
+	}
+	return nil
+}
+
+// Save writes the routing table to path.
+func (t *RoutingTable) Save(path string) error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadRoutingTable reads a routing table written by Save.
+func LoadRoutingTable(path string) (*RoutingTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &RoutingTable{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("routing table %s: %w", path, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// missingShardsHeader lists the leaders of the shards a partial select
+// couldn't reach.
+const missingShardsHeader = "X-Missing-Shards"
+
+// selectOrder is how the Router sorts the features of a scatter-gather
+// select: by id, or by a property with ties broken by id.
+type selectOrder struct {
+	property string
+	desc     bool
+}
+
+// parseOrder parses the sort query parameter: "id" or a property name,
+// prefixed with "-" for descending order.
+func parseOrder(raw string) selectOrder {
+	order := selectOrder{property: strings.TrimPrefix(raw, "-"), desc: strings.HasPrefix(raw, "-")}
+	if order.property == "id" {
+		order.property = ""
+	}
+	return order
+}
+
+// compareValues orders property values: numbers before strings, and missing
+// or other values last.
+func compareValues(a, b any) int {
+	rank := func(v any) int {
+		switch v.(type) {
+		case float64:
+			return 0
+		case string:
+			return 1
+		}
+		return 2
+	}
+	if c := cmp.Compare(rank(a), rank(b)); c != 0 {
+		return c
+	}
+	switch a := a.(type) {
+	case float64:
+		return cmp.Compare(a, b.(float64))
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	return 0
+}
+
+func (o selectOrder) compare(a, b *geojson.Feature) int {
+	c := 0
+	if o.property != "" {
+		c = compareValues(a.Properties[o.property], b.Properties[o.property])
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID.(string), b.ID.(string))
+	}
+	if o.desc {
+		return -c
+	}
+	return c
+}
+
+// dedup keeps one copy of every feature. A feature found on several shards,
+// as when it is being moved between them, is taken from a shard the routing
+// table assigns that copy to, or else from the first shard. Of a feature
+// moved by a replace, only the copy the move shows is kept.
+func (r *Router) dedup(cols []*geojson.FeatureCollection, shards []*Shard) []*geojson.Feature {
+	owns := func(shard *Shard, feature *geojson.Feature) bool {
+		owner, err := r.routes().Locate(feature.ID.(string), feature.Geometry.Bound())
+		return err == nil && owner == shard
+	}
+	var features []*geojson.Feature
+	from := make(map[string]int)
+	seen := make(map[string]int)
+	for i, col := range cols {
+		if col == nil {
+			continue
+		}
+		for _, feature := range col.Features {
+			id := feature.ID.(string)
+			if r.hidden(id, shards[i].LeaderAddr) {
+				continue
+			}
+			at, dup := seen[id]
+			if !dup {
+				seen[id], from[id] = len(features), i
+				features = append(features, feature)
+				continue
+			}
+			if !owns(shards[from[id]], features[at]) && owns(shards[i], feature) {
+				features[at], from[id] = feature, i
+			}
+		}
+	}
+	return features
+}
+
+// routeSelect sends a select to the shard whose sectors hold the rect. A
+// rect over several shards is sent to all of them in parallel, and their
+// features are merged, deduplicated, sorted and limited:
+//
+//   - sort orders by "id", the default, or by a property, "-" for
+//     descending
+//   - limit keeps the first features
+//   - strict=true fails with 502 if a shard doesn't answer, instead of
+//     answering with the features of the others and the missing shards in
+//     the X-Missing-Shards header
+func (r *Router) routeSelect(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	var rect *orb.Bound
+	if get := query.Get("rect"); get != "" {
+		bound, err := parseRect(get)
+		if err != nil {
+			http.Error(w, "invalid rect: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rect = &bound
+	}
+	limit := -1
+	if get := query.Get("limit"); get != "" {
+		n, err := strconv.Atoi(get)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	strict, err := strconv.ParseBool(cmp.Or(query.Get("strict"), "false"))
+	if err != nil {
+		http.Error(w, "invalid strict", http.StatusBadRequest)
+		return
+	}
+	order := parseOrder(query.Get("sort"))
+
+	table := r.routes()
+	if rect != nil {
+		var sectors [][4]float64
+		for _, s := range table.search(*rect) {
+			sectors = append(sectors, fromBound(s.bound))
+		}
+		r.load.record(loadRead, 0, sectors...)
+	}
+	shards := table.Overlapping(rect)
+	if len(shards) == 1 && limit < 0 && !query.Has("sort") && !r.movesPending() {
+		r.forward(w, req, shards[0].LeaderAddr)
+		return
+	}
+	cols, errs := r.gather(req.Context(), "GET", req.URL.RequestURI(), nil, shards)
+
+	var missing []string
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		var status *statusError
+		if errors.As(err, &status) && status.code >= 400 && status.code < 500 {
+			// the shards would all refuse it
+			http.Error(w, status.body, status.code)
+			return
+		}
+		slog.Error("select from shard", slog.String("shard", shards[i].LeaderAddr), slog.String("error", err.Error()))
+		missing = append(missing, shards[i].LeaderAddr)
+	}
+	if len(missing) > 0 && (strict || len(missing) == len(shards)) {
+		http.Error(w, fmt.Sprintf("shards unavailable: %s", strings.Join(missing, ",")), http.StatusBadGateway)
+		return
+	}
+
+	merged := geojson.NewFeatureCollection()
+	merged.Features = r.dedup(cols, shards)
+	slices.SortStableFunc(merged.Features, order.compare)
+	if limit >= 0 && len(merged.Features) > limit {
+		merged.Features = merged.Features[:limit]
+	}
+	if len(missing) > 0 {
+		w.Header().Set(missingShardsHeader, strings.Join(missing, ","))
+	}
+	writeCollection(w, merged)
+}
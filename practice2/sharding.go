@@ -0,0 +1,273 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/paulmach/orb"
+)
+
+// ShardingStrategy decides which shard holds a feature. It is chosen per
+// deployment and saved with the routing table.
+type ShardingStrategy interface {
+	// Kind names the strategy in the saved routing table.
+	Kind() string
+	// Sectors splits the map among the shards. A strategy sharding by id
+	// returns none.
+	Sectors(shards []*Shard) []*sector
+	// Owner returns the shard of a feature id, nil for a strategy sharding
+	// by geometry.
+	Owner(id string, shards []*Shard) *Shard
+}
+
+func newStrategy(kind string) (ShardingStrategy, error) {
+	switch kind {
+	case "grid":
+		return &GridStrategy{}, nil
+	case "geohash":
+		return &GeohashStrategy{}, nil
+	case "quadtree":
+		return &QuadtreeStrategy{}, nil
+	case "hash":
+		return &HashStrategy{}, nil
+	}
+	return nil, fmt.Errorf("unknown sharding strategy %q", kind)
+}
+
+// spread gives cell i of n cells, in an order that keeps neighbours close,
+// to a shard, so that every shard gets a contiguous run of cells.
+func spread(i, n int, shards []*Shard) *Shard {
+	return shards[i*len(shards)/n]
+}
+
+// GridStrategy splits the map into Columns by Rows equal cells. It suits
+// data spread evenly over the map, such as points all over the world.
+type GridStrategy struct {
+	Columns int `json:"columns"`
+	Rows    int `json:"rows"`
+}
+
+func (g *GridStrategy) Kind() string { return "grid" }
+
+func (g *GridStrategy) Sectors(shards []*Shard) []*sector {
+	columns, rows := max(g.Columns, 1), max(g.Rows, 1)
+	width := (world.Max.X() - world.Min.X()) / float64(columns)
+	height := (world.Max.Y() - world.Min.Y()) / float64(rows)
+	var sectors []*sector
+	for c := range columns {
+		for r := range rows {
+			bound := orb.Bound{
+				Min: orb.Point{world.Min.X() + float64(c)*width, world.Min.Y() + float64(r)*height},
+				Max: orb.Point{world.Min.X() + float64(c+1)*width, world.Min.Y() + float64(r+1)*height},
+			}
+			if c == columns-1 {
+				bound.Max[0] = world.Max.X()
+			}
+			if r == rows-1 {
+				bound.Max[1] = world.Max.Y()
+			}
+			sectors = append(sectors, &sector{bound: bound, shard: spread(c*rows+r, columns*rows, shards)})
+		}
+	}
+	return sectors
+}
+
+func (g *GridStrategy) Owner(string, []*Shard) *Shard { return nil }
+
+// maxGeohashPrecision keeps the number of sectors, 32 to the precision,
+// reasonable.
+const maxGeohashPrecision = 3
+
+// GeohashStrategy splits the map into the cells of geohashes of Precision
+// characters, and gives every shard a run of consecutive geohashes: cells
+// sharing a prefix are neighbours, so shards stay compact.
+type GeohashStrategy struct {
+	Precision int `json:"precision"`
+}
+
+func (g *GeohashStrategy) Kind() string { return "geohash" }
+
+func (g *GeohashStrategy) Sectors(shards []*Shard) []*sector {
+	bits := 5 * min(max(g.Precision, 1), maxGeohashPrecision)
+	lonBits, latBits := (bits+1)/2, bits/2
+	width := (world.Max.X() - world.Min.X()) / float64(int(1)<<lonBits)
+	height := (world.Max.Y() - world.Min.Y()) / float64(int(1)<<latBits)
+	n := 1 << bits
+	sectors := make([]*sector, 0, n)
+	for hash := range n {
+		// the bits of a geohash alternate longitude and latitude
+		var x, y int
+		for bit := range bits {
+			b := hash >> (bits - 1 - bit) & 1
+			if bit%2 == 0 {
+				x = x<<1 | b
+			} else {
+				y = y<<1 | b
+			}
+		}
+		bound := orb.Bound{
+			Min: orb.Point{world.Min.X() + float64(x)*width, world.Min.Y() + float64(y)*height},
+			Max: orb.Point{world.Min.X() + float64(x+1)*width, world.Min.Y() + float64(y+1)*height},
+		}
+		sectors = append(sectors, &sector{bound: bound, shard: spread(hash, n, shards)})
+	}
+	return sectors
+}
+
+func (g *GeohashStrategy) Owner(string, []*Shard) *Shard { return nil }
+
+// QuadtreeStrategy splits the map into quadtree cells, named by quadkeys of
+// the digits 0 to 3 for the south-west, south-east, north-west and
+// north-east quarters. Dense areas get deeper cells, so a city full of
+// features is spread over several shards. Every shard gets a run of cells
+// in quadkey order.
+type QuadtreeStrategy struct {
+	Leaves []string `json:"leaves"`
+}
+
+// NewQuadtreeStrategy splits the cells holding more than capacity of the
+// sample points, down to maxDepth.
+func NewQuadtreeStrategy(sample []orb.Point, capacity, maxDepth int) *QuadtreeStrategy {
+	q := &QuadtreeStrategy{}
+	var split func(key string, points []orb.Point)
+	split = func(key string, points []orb.Point) {
+		if len(points) <= capacity || len(key) >= maxDepth {
+			q.Leaves = append(q.Leaves, key)
+			return
+		}
+		quarters := make([][]orb.Point, 4)
+		for _, p := range points {
+			d := quadrant(quadBound(key), p)
+			quarters[d] = append(quarters[d], p)
+		}
+		for d := range 4 {
+			split(key+strconv.Itoa(d), quarters[d])
+		}
+	}
+	split("", sample)
+	return q
+}
+
+// quadrant returns the digit of the quarter of bound holding p.
+func quadrant(bound orb.Bound, p orb.Point) int {
+	center := bound.Center()
+	d := 0
+	if p.X() >= center.X() {
+		d |= 1
+	}
+	if p.Y() >= center.Y() {
+		d |= 2
+	}
+	return d
+}
+
+// quadBound returns the cell of a quadkey.
+func quadBound(key string) orb.Bound {
+	bound := world
+	for _, digit := range key {
+		center := bound.Center()
+		d := int(digit - '0')
+		if d&1 == 0 {
+			bound.Max[0] = center.X()
+		} else {
+			bound.Min[0] = center.X()
+		}
+		if d&2 == 0 {
+			bound.Max[1] = center.Y()
+		} else {
+			bound.Min[1] = center.Y()
+		}
+	}
+	return bound
+}
+
+func (q *QuadtreeStrategy) Kind() string { return "quadtree" }
+
+func (q *QuadtreeStrategy) Sectors(shards []*Shard) []*sector {
+	leaves := slices.Clone(q.Leaves)
+	if len(leaves) == 0 {
+		leaves = []string{""}
+	}
+	// every shard needs a cell
+	for len(leaves) < len(shards) {
+		var deeper []string
+		for _, key := range leaves {
+			for d := range 4 {
+				deeper = append(deeper, key+strconv.Itoa(d))
+			}
+		}
+		leaves = deeper
+	}
+	slices.Sort(leaves)
+	sectors := make([]*sector, 0, len(leaves))
+	for i, key := range leaves {
+		sectors = append(sectors, &sector{bound: quadBound(key), shard: spread(i, len(leaves), shards)})
+	}
+	return sectors
+}
+
+func (q *QuadtreeStrategy) Owner(string, []*Shard) *Shard { return nil }
+
+// defaultVirtualNodes is how many points a shard has on the hash ring.
+const defaultVirtualNodes = 64
+
+// HashStrategy shards by a consistent hash of the feature id, ignoring the
+// geometry: shards are even however dense the map, but every select goes to
+// all of them. Adding a shard only moves the ids it takes over.
+type HashStrategy struct {
+	VirtualNodes int `json:"virtualNodes"`
+
+	mu     sync.Mutex
+	shards []*Shard
+	ring   []ringPoint
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard *Shard
+}
+
+// hash64 hashes a string onto the ring. FNV alone leaves similar strings,
+// like pin1 and pin2, close on the ring, the finalizer of MurmurHash3 mixes
+// them.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (h *HashStrategy) Kind() string { return "hash" }
+
+func (h *HashStrategy) Sectors([]*Shard) []*sector { return nil }
+
+func (h *HashStrategy) Owner(id string, shards []*Shard) *Shard {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !slices.Equal(h.shards, shards) {
+		h.shards = slices.Clone(shards)
+		h.ring = h.ring[:0]
+		vnodes := cmp.Or(h.VirtualNodes, defaultVirtualNodes)
+		for _, shard := range shards {
+			for i := range vnodes {
+				h.ring = append(h.ring, ringPoint{hash: hash64(shard.LeaderAddr + "#" + strconv.Itoa(i)), shard: shard})
+			}
+		}
+		slices.SortFunc(h.ring, func(a, b ringPoint) int { return cmp.Compare(a.hash, b.hash) })
+	}
+	key := hash64(id)
+	i, _ := slices.BinarySearchFunc(h.ring, key, func(p ringPoint, key uint64) int { return cmp.Compare(p.hash, key) })
+	if i == len(h.ring) {
+		i = 0
+	}
+	return h.ring[i].shard
+}
@@ -6,33 +6,136 @@ import (
 	"errors"
 	"log/slog"
 	"os"
-	"strconv"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
 	"github.com/tidwall/rtree"
 )
 
+var (
+	errNotFound = errors.New("feature not found")
+	errExists   = errors.New("feature already exists")
+)
+
 type Transaction struct {
-	Action  string           `json:"action"`
-	Name    string           `json:"name"`
-	LSN     uint64           `json:"lsn"`
+	Action  string            `json:"action"`
+	Name    string            `json:"name"`
+	LSN     uint64            `json:"lsn"`
+	Version uint64            `json:"version,omitempty"`
+	Term    uint64            `json:"term,omitempty"`
+	Clock   map[string]uint64 `json:"clock,omitempty"`
+	HLC     uint64            `json:"hlc,omitempty"`
+	Time    int64             `json:"time,omitempty"`
+	// Seq is the order the transaction was applied in on this node, which
+	// the history is read by: the LSNs of the nodes that made its
+	// transactions can't be compared.
+	Seq uint64 `json:"seq,omitempty"`
+	// Repair marks the state of a feature taken from a replica by
+	// anti-entropy, logged with the name and clock the replica had. It
+	// replaces the local state and is never replicated, see fix.
+	Repair  bool             `json:"repair,omitempty"`
 	Feature *geojson.Feature `json:"feature"`
+	Patch   *Patch           `json:"patch,omitempty"`
+
+	// Siblings are the concurrent versions of the feature, in checkpoints
+	Siblings []*sibling `json:"siblings,omitempty"`
+
+	// size is how many bytes the transaction takes in the log or the
+	// checkpoint, what the feature counts for in the sizes of the cells
+	size int64
+}
+
+// record is a feature stored in the primary index. version starts at 1 and
+// grows with every replace of the feature. clock is the version vector of
+// the feature, hlc and name tell when and where it was changed last, see
+// resolve.
+type record struct {
+	feature  *geojson.Feature
+	version  uint64
+	clock    map[string]uint64
+	hlc      uint64
+	name     string
+	siblings []*sibling
+	// size is how many bytes the record took in the log, see count
+	size int64
+}
+
+type response struct {
+	data []byte
+	err  error
 }
 
 type Engine struct {
+	name           string
 	mu             sync.Mutex
-	primary        map[string]*geojson.Feature
+	primary        map[string]*record
+	trash          map[string]*tombstone
+	trashTTL       time.Duration
 	spatial        *rtree.RTree
+	cells          map[[4]float64]*cellSize
 	lsn            atomic.Uint64
+	vclock         map[string]uint64
+	progress       chan struct{}
 	logFile        *os.File
 	checkpointPath string
-	ctx            context.Context
-	cancel         context.CancelFunc
+	historyPath    string
+
+	// history holds the log records kept for the retention period, see
+	// retain. Records checkpointed already are moved from the log to the
+	// history file. seq is the Seq of the last record.
+	history     []*Transaction
+	seq         uint64
+	retention   time.Duration
+	horizon     uint64
+	horizonLSN  uint64
+	horizonTime int64
+	// holds of the Routers migrating sectors off this Storage, see hold
+	holds map[string]*migrationHold
+	// table is set on a metadata Storage, see keepTable
+	table bool
+
+	// concurrent changes of a feature, see resolve
+	policy   ConflictPolicy
+	hlc      uint64
+	resolved []*resolution
+
+	// only the leader creates transactions, followers know its address
+	leader     bool
+	leaderAddr string
+
+	// election state, used when addr is set: see elect. Every transaction
+	// is logged with the term of the leader that made it.
+	addr        string
+	term        uint64
+	votedFor    string
+	fence       map[string]uint64
+	lastTerm    uint64
+	leaderName  string
+	lastContact time.Time
+	lastQuorum  time.Time
+	timeout     time.Duration
+	termPath    string
+	redial      chan struct{}
+
+	// replicas are the addresses of the Storages this engine receives
+	// transactions from, peers are the replicas it sends local ones to
+	replicas []string
+	inbox    chan *inbound
+	peersMu  sync.Mutex
+	peers    map[string]*peer
+	acks     map[string]uint64
+	acked    chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewEngine(logPath, checkpointPath string) (*Engine, error) {
+func NewEngine(name, logPath, checkpointPath, historyPath, termPath string) (*Engine, error) {
 	logFile, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
@@ -41,18 +144,40 @@ func NewEngine(logPath, checkpointPath string) (*Engine, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	engine := &Engine{
-		primary:        make(map[string]*geojson.Feature),
+		name:           name,
+		primary:        make(map[string]*record),
+		trash:          make(map[string]*tombstone),
+		holds:          make(map[string]*migrationHold),
+		vclock:         make(map[string]uint64),
+		progress:       make(chan struct{}),
+		trashTTL:       defaultTrashTTL,
+		leader:         true,
 		spatial:        &rtree.RTree{},
+		cells:          make(map[[4]float64]*cellSize),
 		logFile:        logFile,
 		checkpointPath: checkpointPath,
+		historyPath:    historyPath,
+		termPath:       termPath,
+		timeout:        electionTimeout,
+		redial:         make(chan struct{}),
+		inbox:          make(chan *inbound),
+		peers:          make(map[string]*peer),
+		acks:           make(map[string]uint64),
+		acked:          make(chan struct{}),
 		ctx:            ctx,
 		cancel:         cancel,
 	}
 
 	// Load checkpoint and replay log
+	if err := engine.loadTerm(); err != nil {
+		return nil, err
+	}
 	if err := engine.loadCheckpoint(); err != nil {
 		return nil, err
 	}
+	if err := engine.loadHistory(); err != nil {
+		return nil, err
+	}
 	if err := engine.replayLog(); err != nil {
 		return nil, err
 	}
@@ -72,130 +197,370 @@ func (e *Engine) loadCheckpoint() error {
 
 	decoder := json.NewDecoder(file)
 	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			break
+		}
+		var header checkpointHeader
+		if err := json.Unmarshal(raw, &header); err == nil && header.Action == "checkpoint" {
+			e.lsn.Store(header.LSN)
+			e.lastTerm = header.LastTerm
+			for name, lsn := range header.VClock {
+				e.vclock[name] = lsn
+			}
+			e.seq = header.Seq
+			e.horizon = header.Horizon
+			e.horizonLSN = header.HorizonLSN
+			e.horizonTime = header.HorizonTime
+			continue
+		}
 		var txn Transaction
-		if err := decoder.Decode(&txn); err != nil {
+		if err := json.Unmarshal(raw, &txn); err != nil {
 			break
 		}
+		txn.size = int64(len(raw))
 		e.applyTransaction(&txn)
 	}
 	return nil
 }
 
+// replayLog applies the log records made after the checkpoint.
 func (e *Engine) replayLog() error {
 	decoder := json.NewDecoder(e.logFile)
 	for {
 		var txn Transaction
+		start := decoder.InputOffset()
 		if err := decoder.Decode(&txn); err != nil {
 			break
 		}
+		txn.size = decoder.InputOffset() - start
+		if txn.Repair {
+			e.sequence(&txn)
+			e.history = append(e.history, &txn)
+			e.applyRepair(&txn)
+			continue
+		}
+		if e.seen(&txn) || e.fenced(&txn) {
+			continue
+		}
+		e.tick(&txn)
+		if txn.Name == e.name && txn.LSN > e.lsn.Load() {
+			e.lsn.Store(txn.LSN)
+		}
+		e.sequence(&txn)
+		e.history = append(e.history, &txn)
 		e.applyTransaction(&txn)
 	}
 	return nil
 }
 
+// bound returns the corners of the feature geometry's bounding box as used
+// by the spatial index.
+func bound(feature *geojson.Feature) (min, max [2]float64) {
+	b := feature.Geometry.Bound()
+	return b.Min, b.Max
+}
+
 func (e *Engine) applyTransaction(txn *Transaction) ([]byte, error) {
 	slog.Info("", slog.String("method", "transaction"), slog.String("action", txn.Action))
 	switch txn.Action {
-	case "insert", "replace":
-		e.primary[txn.Feature.ID.(string)] = txn.Feature
-		e.spatial.Insert(txn.Feature.BBox.Bound().Min, txn.Feature.BBox.Bound().Max, txn.Feature)
+	case "insert", "replace", "patch", "undelete":
+		id := txn.Feature.ID.(string)
+		version := txn.Version
+		old, exists := e.primary[id]
+		if version == 0 {
+			version = e.nextVersion(id)
+		}
+		rec, ok := e.resolve(id, txn, &record{feature: txn.Feature, version: version, clock: txn.Clock, hlc: txn.HLC, name: txn.Name, siblings: txn.Siblings, size: txn.size})
+		if !ok {
+			return nil, nil
+		}
+		delete(e.trash, id)
+		// the spatial index holds ids, so it only changes with the geometry
+		if !e.keepsTable(id) && (!exists || !orb.Equal(old.feature.Geometry, rec.feature.Geometry)) {
+			if exists {
+				min, max := bound(old.feature)
+				e.spatial.Delete(min, max, id)
+			}
+			min, max := bound(rec.feature)
+			e.spatial.Insert(min, max, id)
+		}
+		if exists {
+			e.count(old, -1)
+		}
+		e.count(rec, 1)
+		e.primary[id] = rec
 		return nil, nil
 	case "delete":
-		if feature, exists := e.primary[txn.Feature.ID.(string)]; exists {
-			e.spatial.Delete(feature.BBox.Bound().Min, feature.BBox.Bound().Max, feature)
-			delete(e.primary, txn.Feature.ID.(string))
+		id := txn.Feature.ID.(string)
+		if old, exists := e.primary[id]; exists {
+			// the tombstone keeps the deleted version with the clock of the delete
+			rec, ok := e.resolve(id, txn, &record{feature: old.feature, version: old.version, clock: txn.Clock, hlc: txn.HLC, name: txn.Name})
+			if !ok {
+				return nil, nil
+			}
+			min, max := bound(old.feature)
+			e.spatial.Delete(min, max, id)
+			e.count(old, -1)
+			delete(e.primary, id)
+			e.trash[id] = &tombstone{record: *rec, deletedAt: txn.Time}
 			return nil, nil
 		}
-		return nil, errors.New("can't delete by id" + txn.Feature.ID.(string) + ": no such enrty")
+		return nil, errors.New("can't delete by id" + id + ": no such enrty")
+	case "purge":
+		delete(e.trash, txn.Feature.ID.(string))
+		return nil, nil
+	case "evict":
+		e.forget(txn.Feature.ID.(string))
+		return nil, nil
 	case "select":
-		col := geojson.NewFeatureCollection()
-		e.spatial.Scan(func(min, max [2]float64, data interface{}) bool {
-			col.Append(data.(*geojson.Feature))
+		var features []*geojson.Feature
+		collect := func(min, max [2]float64, data interface{}) bool {
+			features = append(features, e.primary[data.(string)].feature)
 			return true
+		}
+		if txn.Feature == nil {
+			e.spatial.Scan(collect)
+		} else {
+			min, max := bound(txn.Feature)
+			e.spatial.Search(min, max, collect)
+		}
+		slices.SortFunc(features, func(a, b *geojson.Feature) int {
+			return strings.Compare(a.ID.(string), b.ID.(string))
 		})
+		col := geojson.NewFeatureCollection()
+		col.Features = append(col.Features, features...)
 		return col.MarshalJSON()
-	case "checkpoint":
-		f, err := os.Open(txn.Name + strconv.FormatUint(e.lsn.Load(), 10) + e.checkpointPath)
-		if err != nil {
-			slog.Error("can't open checkpoint file")
-			return nil, err
-		}
-		defer func() { _ = f.Close() }()
+	default:
+		panic("unknown action")
+	}
+}
 
-		e.mu.Lock()
-		col := drain(e.primary)
-		e.mu.Unlock()
-		data, err := col.MarshalJSON()
-		if err != nil {
-			slog.Error("error on marshaling collection", slog.String("error", err.Error()))
-			return nil, err
+// validate checks a modifying transaction against the current state before
+// it is written to the log.
+func (e *Engine) validate(txn *Transaction) error {
+	_, exists := e.primary[txn.Feature.ID.(string)]
+	_, trashed := e.trash[txn.Feature.ID.(string)]
+	switch txn.Action {
+	case "insert":
+		if exists {
+			return errExists
 		}
-		if _, err := f.Write(data); err != nil {
-			slog.Error("error on writing checkpoint", slog.String("error", err.Error()))
-			return nil, err
+	case "replace", "patch", "delete":
+		if !exists {
+			return errNotFound
 		}
-		return nil, nil
-	default:
-		panic("unknown action")
+	case "undelete":
+		if exists {
+			return errExists
+		}
+		fallthrough
+	case "purge":
+		if !trashed {
+			return errNotFound
+		}
+	case "evict":
+		if !exists && !trashed {
+			return errNotFound
+		}
+	}
+	return nil
+}
+
+// nextVersion returns the version a feature gets with its next change. An
+// inserted feature starts over, an undeleted one continues from its
+// tombstone.
+func (e *Engine) nextVersion(id string) uint64 {
+	if rec, exists := e.primary[id]; exists {
+		return rec.version + 1
+	}
+	if t, trashed := e.trash[id]; trashed {
+		return t.version + 1
 	}
+	return 1
+}
+
+// get returns copies of the records stored under ids, in the same order,
+// and the ids that are not stored.
+func (e *Engine) get(ids []string) (found []record, missing []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, id := range ids {
+		if rec, exists := e.primary[id]; exists {
+			found = append(found, *rec)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return found, missing
 }
 
 func (e *Engine) saveTransaction(txn *Transaction) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	if !e.leader {
+		return errNotLeader
+	}
+	if err := e.validate(txn); err != nil {
+		return err
+	}
+	switch txn.Action {
+	case "insert":
+		txn.Version = 1
+	case "replace", "patch":
+		txn.Version = e.nextVersion(txn.Feature.ID.(string))
+	case "undelete":
+		// undelete is logged with the image of the restored feature
+		t := e.trash[txn.Feature.ID.(string)]
+		txn.Version = t.version + 1
+		txn.Feature = t.feature
+	}
+	// patches are logged as the full image of the patched feature
+	if txn.Action == "patch" {
+		feature, err := applyPatch(e.primary[txn.Feature.ID.(string)].feature, txn.Patch)
+		if err != nil {
+			return err
+		}
+		txn.Feature = feature
+		txn.Patch = nil
+	}
+	if e.moving(txn) {
+		return errFenced
+	}
+
 	e.lsn.Add(1)
 	txn.LSN = e.lsn.Load()
+	txn.Term = e.term
+	txn.Time = time.Now().UnixNano()
+	if txn.Action != "purge" && txn.Action != "evict" {
+		e.stamp(txn)
+	}
+	e.tick(txn)
+	e.seq++
+	txn.Seq = e.seq
 
 	data, err := json.Marshal(txn)
 	if err != nil {
 		return err
 	}
+	txn.size = int64(len(data))
 
 	if _, err := e.logFile.Write(append(data, '\n')); err != nil {
 		return err
 	}
-	e.applyTransaction(txn)
+	e.history = append(e.history, txn)
+	if _, err = e.applyTransaction(txn); err != nil {
+		return err
+	}
+	if txn.Name == e.name {
+		e.broadcast(txn)
+	}
 	return nil
 }
 
 func (e *Engine) check() error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
+	return e.checkpoint()
+}
 
+// checkpoint saves the state to the checkpoint file and moves the log to the
+// history. The caller holds e.mu.
+func (e *Engine) checkpoint() error {
 	file, err := os.Create(e.checkpointPath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	e.retain(time.Now())
 	encoder := json.NewEncoder(file)
-	for _, feature := range e.primary {
-		txn := &Transaction{
-			Action:  "insert",
-			Feature: feature,
-		}
+	header := &checkpointHeader{
+		Action:      "checkpoint",
+		LSN:         e.lsn.Load(),
+		LastTerm:    e.lastTerm,
+		VClock:      e.vclock,
+		Seq:         e.seq,
+		Horizon:     e.horizon,
+		HorizonLSN:  e.horizonLSN,
+		HorizonTime: e.horizonTime,
+	}
+	if err := encoder.Encode(header); err != nil {
+		return err
+	}
+	for _, txn := range e.records() {
 		if err := encoder.Encode(txn); err != nil {
 			return err
 		}
 	}
 
+	if err := e.saveHistory(); err != nil {
+		return err
+	}
 	e.logFile.Truncate(0)
 	e.logFile.Seek(0, 0)
 	return nil
 }
 
-func (e *Engine) Run(jobs chan *Transaction, resp chan struct {
-	data []byte
-	err  error
-}) {
+// records returns the state as a log of transactions: an insert for every
+// feature, and an insert followed by a delete for every tombstone.
+func (e *Engine) records() []*Transaction {
+	txns := make([]*Transaction, 0, len(e.primary)+2*len(e.trash))
+	for _, rec := range e.primary {
+		txns = append(txns, &Transaction{Action: "insert", Name: rec.name, Version: rec.version, Clock: rec.clock, HLC: rec.hlc, Feature: rec.feature, Siblings: rec.siblings})
+	}
+	for _, t := range e.trash {
+		txns = append(txns,
+			&Transaction{Action: "insert", Version: t.version, Feature: t.feature},
+			&Transaction{Action: "delete", Name: t.name, Time: t.deletedAt, Clock: t.clock, HLC: t.hlc, Feature: t.feature},
+		)
+	}
+	return txns
+}
+
+func (e *Engine) Run(jobs chan *Transaction, resp chan response) {
+	go e.sweep()
+	if e.addr != "" {
+		go e.elect()
+	}
+	for _, addr := range e.replicas {
+		go e.connect(addr)
+	}
 	go func() {
 		for {
 			select {
-			case tnx := <-jobs:
-				e.applyTransaction(tnx)
+			case txn := <-jobs:
+				var res response
+				switch txn.Action {
+				case "select":
+					e.mu.Lock()
+					res.data, res.err = e.applyTransaction(txn)
+					e.mu.Unlock()
+				case "checkpoint":
+					res.err = e.check()
+				default:
+					res.err = e.saveTransaction(txn)
+				}
+				resp <- res
+			case in := <-e.inbox:
+				if in.snap != nil {
+					if err := e.install(in.snap); err != nil {
+						slog.Error("can't install snapshot", slog.String("name", in.snap.Name), slog.String("error", err.Error()))
+					}
+				} else if err := e.replicate(in.txn); err != nil {
+					slog.Error("can't replicate", slog.String("name", in.txn.Name), slog.Uint64("lsn", in.txn.LSN), slog.String("error", err.Error()))
+				}
+				close(in.done)
 			case <-e.ctx.Done():
+				e.peersMu.Lock()
+				for name, p := range e.peers {
+					delete(e.peers, name)
+					close(p.send)
+				}
+				e.peersMu.Unlock()
 				e.logFile.Close()
+				return
 			}
 		}
 	}()
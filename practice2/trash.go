@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// defaultTrashTTL is how long deleted features can be restored.
+const defaultTrashTTL = 30 * 24 * time.Hour
+
+// tombstone is a deleted feature kept in the trash until it is purged.
+type tombstone struct {
+	record
+	deletedAt int64
+}
+
+// removed reports whether a transaction leaves its feature hidden from reads.
+func removed(txn *Transaction) bool {
+	return txn.Action == "delete" || txn.Action == "purge" || txn.Action == "evict"
+}
+
+// trashed returns the deleted features ordered by id and the unix time in
+// nanoseconds each of them was deleted at.
+func (e *Engine) trashed() ([]*geojson.Feature, map[string]int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	features := make([]*geojson.Feature, 0, len(e.trash))
+	deletedAt := make(map[string]int64, len(e.trash))
+	for id, t := range e.trash {
+		features = append(features, t.feature)
+		deletedAt[id] = t.deletedAt
+	}
+	slices.SortFunc(features, func(a, b *geojson.Feature) int {
+		return strings.Compare(a.ID.(string), b.ID.(string))
+	})
+	return features, deletedAt
+}
+
+// expired returns the ids of tombstones deleted before the trash TTL.
+func (e *Engine) expired(now time.Time) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cutoff := now.Add(-e.trashTTL).UnixNano()
+	var ids []string
+	for id, t := range e.trash {
+		if t.deletedAt < cutoff {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// sweep purges expired tombstones until the engine is stopped. Purges are
+// transactions, so only the leader makes them.
+func (e *Engine) sweep() {
+	ticker := time.NewTicker(min(e.trashTTL, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if leader, _ := e.role(); !leader {
+				continue
+			}
+			for _, id := range e.expired(now) {
+				feature := &geojson.Feature{}
+				feature.ID = id
+				err := e.saveTransaction(&Transaction{
+					Action:  "purge",
+					Name:    e.name,
+					Feature: feature,
+				})
+				// the feature may have been undeleted since
+				if err != nil && !errors.Is(err, errNotFound) {
+					slog.Error("can't purge", slog.String("id", id), slog.String("error", err.Error()))
+				}
+			}
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// seen reports whether a transaction is already applied according to the
+// vector clock: every node numbers its transactions with increasing LSNs.
+func (e *Engine) seen(txn *Transaction) bool {
+	return txn.LSN <= e.vclock[txn.Name]
+}
+
+// tick advances the vector clock, the last term and the hybrid logical
+// clock past an applied transaction, and wakes the reads waiting for it.
+func (e *Engine) tick(txn *Transaction) {
+	e.vclock[txn.Name] = max(e.vclock[txn.Name], txn.LSN)
+	e.lastTerm = max(e.lastTerm, txn.Term)
+	e.hlc = max(e.hlc, txn.HLC)
+	close(e.progress)
+	e.progress = make(chan struct{})
+}
+
+// clock returns a copy of the vector clock.
+func (e *Engine) clock() map[string]uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	vclock := make(map[string]uint64, len(e.vclock))
+	for name, lsn := range e.vclock {
+		vclock[name] = lsn
+	}
+	return vclock
+}
+
+func (s *Storage) vclockHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("vclock method")
+	writeJSON(w, s.eng.clock())
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// WriteConcern is how many replicas have to persist a write before it is
+// acknowledged to the client.
+type WriteConcern string
+
+const (
+	// WriteLocal acknowledges writes once the local engine has logged them.
+	WriteLocal WriteConcern = "local"
+	// WriteQuorum waits until a majority of the replica set has the write,
+	// this Storage included.
+	WriteQuorum WriteConcern = "quorum"
+	// WriteAll waits for every replica.
+	WriteAll WriteConcern = "all"
+)
+
+const defaultWriteTimeout = 5 * time.Second
+
+var errInvalidConcern = errors.New("invalid write concern")
+
+// ack is sent back by a replica with the LSN of this Storage it has
+// persisted.
+type ack struct {
+	LSN uint64 `json:"lsn"`
+}
+
+// ackError is returned when a write concern isn't satisfied in time. The
+// write itself is not undone: it is stored, and may still reach the
+// replicas.
+type ackError struct {
+	concern  WriteConcern
+	acks     int
+	required int
+}
+
+func (err *ackError) Error() string {
+	return fmt.Sprintf("write concern %s not satisfied: %d of %d replicas acknowledged", err.concern, err.acks, err.required)
+}
+
+// ack records the LSN persisted by a replica and wakes the waiting writes.
+func (e *Engine) ack(name string, lsn uint64) {
+	e.peersMu.Lock()
+	defer e.peersMu.Unlock()
+	if lsn <= e.acks[name] {
+		return
+	}
+	e.acks[name] = lsn
+	close(e.acked)
+	e.acked = make(chan struct{})
+}
+
+// required returns how many replicas have to acknowledge a write under
+// concern.
+func (e *Engine) required(concern WriteConcern) int {
+	switch concern {
+	case WriteQuorum:
+		return e.majority() - 1
+	case WriteAll:
+		return len(e.replicas)
+	default:
+		return 0
+	}
+}
+
+// await waits until n replicas have persisted lsn, and returns how many did
+// when the timeout expires first.
+func (e *Engine) await(lsn uint64, n int, timeout time.Duration) (int, bool) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		e.peersMu.Lock()
+		acks := 0
+		for _, acked := range e.acks {
+			if acked >= lsn {
+				acks++
+			}
+		}
+		wake := e.acked
+		e.peersMu.Unlock()
+		if acks >= n {
+			return acks, true
+		}
+		select {
+		case <-wake:
+		case <-deadline.C:
+			return acks, false
+		case <-e.ctx.Done():
+			return acks, false
+		}
+	}
+}
+
+// WithWriteConcern sets the default write concern of the Storage and how
+// long writes wait for it, WriteLocal by default. Requests may override
+// both with the w and wtimeout query parameters, such as
+// ?w=quorum&wtimeout=2s. WriteQuorum and WriteAll count the replicas given
+// with WithReplicas.
+func WithWriteConcern(concern WriteConcern, timeout time.Duration) StorageOption {
+	return func(s *Storage) {
+		s.concern = concern
+		s.writeTimeout = timeout
+	}
+}
+
+// writeConcern returns the write concern and timeout of a request.
+func (s *Storage) writeConcern(r *http.Request) (WriteConcern, time.Duration, error) {
+	concern, timeout := s.concern, s.writeTimeout
+	query := r.URL.Query()
+	if w := query.Get("w"); w != "" {
+		concern = WriteConcern(w)
+	}
+	switch concern {
+	case "":
+		concern = WriteLocal
+	case WriteLocal, WriteQuorum, WriteAll:
+	default:
+		return "", 0, errInvalidConcern
+	}
+	if raw := query.Get("wtimeout"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return "", 0, errInvalidConcern
+		}
+		timeout = d
+	}
+	if timeout <= 0 {
+		timeout = defaultWriteTimeout
+	}
+	return concern, timeout, nil
+}
+
+// writeUnacked answers 503 to an insert whose write concern timed out,
+// with the id of the feature: it is stored already, so a client retrying
+// should look it up, or replace it, rather than insert it again. The
+// consistency token is set by write.
+func writeUnacked(w http.ResponseWriter, err *ackError, id string) {
+	data, _ := json.Marshal(map[string]string{"id": id, "error": err.Error()})
+	w.Header().Set("X-Write-Acks", strconv.Itoa(err.acks))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(data)
+}
+
+// write executes a modifying transaction and waits for the write concern of
+// the request. The consistency token of the write is set on the response.
+func (s *Storage) write(w http.ResponseWriter, r *http.Request, txn *Transaction) response {
+	concern, timeout, err := s.writeConcern(r)
+	if err != nil {
+		return response{err: err}
+	}
+	res := s.exec(txn)
+	if res.err != nil {
+		return res
+	}
+	w.Header().Set(tokenHeader, consistencyToken{name: txn.Name, lsn: txn.LSN}.String())
+	n := s.eng.required(concern)
+	if n == 0 {
+		return res
+	}
+	if acks, ok := s.eng.await(txn.LSN, n, timeout); !ok {
+		res.err = &ackError{concern: concern, acks: acks, required: n}
+	}
+	return res
+}